@@ -0,0 +1,185 @@
+/*
+
+discovery/bans.go
+
+checking bans and building the messages shown for them
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// the format that times are shown to banned users in
+const banTimeFormat = "2006-01-02 15:04 MST"
+
+// expired checks if a ban has run out at the given time
+func (b ban) expired(now time.Time) bool {
+
+	return b.Expires != nil && !now.Before(*b.Expires)
+
+}
+
+// message builds the message shown to a banned user. the reason can
+// contain {expires}, {issued} and {issuer}, which are filled in
+func (b ban) message() string {
+
+	// what {expires} is replaced with
+	expires := "never"
+	if b.Expires != nil {
+
+		expires = b.Expires.UTC().Format(banTimeFormat)
+
+	}
+
+	// what {issued} is replaced with
+	issued := "unknown"
+	if b.Issued != nil {
+
+		issued = b.Issued.UTC().Format(banTimeFormat)
+
+	}
+
+	// fill them in
+	return strings.NewReplacer(
+		"{expires}", expires,
+		"{issued}", issued,
+		"{issuer}", b.Issuer,
+	).Replace(b.Reason)
+
+}
+
+// ipBanEntry is a single entry of the ip bans, as it is written in the config or at a url
+type ipBanEntry struct {
+	Reason    string `json:"reason"`
+	Code      int    `json:"code,omitempty"`
+	ErrorCode int    `json:"errorCode,omitempty"`
+}
+
+// ipBan refuses every request from a network
+type ipBan struct {
+	Network   *net.IPNet
+	Reason    string
+	Code      int
+	ErrorCode int
+}
+
+// parseNetwork parses either a cidr range or a single ipv4 or ipv6 address
+func parseNetwork(network string) (*net.IPNet, error) {
+
+	// check if it's a range
+	if strings.Contains(network, "/") {
+
+		_, parsed, err := net.ParseCIDR(network)
+		return parsed, err
+
+	}
+
+	// otherwise, it's a single address
+	ip := net.ParseIP(network)
+	if ip == nil {
+
+		return nil, fmt.Errorf("%q is neither an ip address nor a cidr range", network)
+
+	}
+
+	// which is a range with only itself in it
+	if ipv4 := ip.To4(); ipv4 != nil {
+
+		return &net.IPNet{IP: ipv4, Mask: net.CIDRMask(32, 32)}, nil
+
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+
+}
+
+// newIPBans turns the entries of the ip bans into bans, skipping the ones with invalid networks
+func newIPBans(entries map[string]ipBanEntry) []ipBan {
+
+	// the bans
+	bans := []ipBan{}
+
+	// parse each of them
+	for network, entry := range entries {
+
+		// parse the network
+		parsed, err := parseNetwork(network)
+		if err != nil {
+
+			log.Printf("[err]: ip ban %s is invalid, ignoring it...\n", network)
+			log.Printf("       error: %v\n", err)
+			continue
+
+		}
+
+		bans = append(bans, newIPBan(parsed, entry))
+
+	}
+
+	return bans
+
+}
+
+// newIPBan fills in the defaults of an ip ban
+func newIPBan(network *net.IPNet, entry ipBanEntry) ipBan {
+
+	// the ban
+	banned := ipBan{
+		Network:   network,
+		Reason:    entry.Reason,
+		Code:      entry.Code,
+		ErrorCode: entry.ErrorCode,
+	}
+
+	// they get the same codes as a normal ban unless they say otherwise
+	if banned.Code == 0 {
+
+		banned.Code = 400
+
+	}
+	if banned.ErrorCode == 0 {
+
+		banned.ErrorCode = 7
+
+	}
+
+	return banned
+
+}
+
+// matchIPBans returns the ban that covers an address, if there is one
+func matchIPBans(bans []ipBan, address string) (ipBan, bool) {
+
+	// parse the address
+	ip := net.ParseIP(address)
+	if ip == nil {
+
+		return ipBan{}, false
+
+	}
+
+	// check each ban
+	for _, banned := range bans {
+
+		if banned.Network.Contains(ip) {
+
+			return banned, true
+
+		}
+
+	}
+
+	return ipBan{}, false
+
+}
@@ -0,0 +1,118 @@
+/*
+
+discovery/bypass.go
+
+letting staff and testers skip maintenance
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"fmt"
+	"net"
+)
+
+// bypassOptions is the maintenanceBypass section of the options
+type bypassOptions struct {
+	Tokens   []string
+	Groups   []string
+	Networks []*net.IPNet
+	Group    string
+}
+
+// maintenanceBypass is the allowlist of consoles that skip maintenance
+type maintenanceBypass struct {
+	tokens   *tokenIndex
+	groups   map[string]bool
+	networks []*net.IPNet
+	group    string
+}
+
+// newMaintenanceBypass creates the allowlist from the options. there is no allowlist
+// if nothing is on it
+func newMaintenanceBypass(settings bypassOptions) *maintenanceBypass {
+
+	// check if anything is on it
+	if len(settings.Tokens) == 0 && len(settings.Groups) == 0 && len(settings.Networks) == 0 {
+
+		return nil
+
+	}
+
+	// the allowlist
+	bypass := &maintenanceBypass{
+		tokens:   newTokenIndex("maintenanceBypass", settings.Tokens),
+		groups:   map[string]bool{},
+		networks: settings.Networks,
+		group:    settings.Group,
+	}
+	for _, group := range settings.Groups {
+
+		bypass.groups[group] = true
+
+	}
+
+	return bypass
+
+}
+
+// allows checks if a console skips maintenance, returning why it does
+func (b *maintenanceBypass) allows(tokenFingerprint string, candidates []string, address string, group string) (string, bool) {
+
+	// nobody does without an allowlist
+	if b == nil {
+
+		return "", false
+
+	}
+
+	// check where they're connecting from
+	if ip := net.ParseIP(address); ip != nil {
+
+		for _, network := range b.networks {
+
+			if network.Contains(ip) {
+
+				return fmt.Sprintf("network %s", network), true
+
+			}
+
+		}
+
+	}
+
+	// check the group they were given
+	if b.groups[group] {
+
+		return fmt.Sprintf("endpoints group %s", group), true
+
+	}
+
+	// check their servicetoken
+	if key, ok := b.tokens.lookup(tokenFingerprint, candidates); ok {
+
+		return fmt.Sprintf("servicetoken %s", key), true
+
+	}
+
+	return "", false
+
+}
+
+// staging returns the group consoles that skip maintenance are sent to, if there is one
+func (b *maintenanceBypass) staging() (string, bool) {
+
+	if b == nil || b.group == "" {
+
+		return "", false
+
+	}
+
+	return b.group, true
+
+}
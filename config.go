@@ -0,0 +1,2053 @@
+/*
+
+discovery/config.go
+
+the typed configuration model, and the validation pass
+that builds it out of config.yaml
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	// externals
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// configuration is the validated contents of config.yaml
+type configuration struct {
+	Options   options
+	Endpoints map[string]endpointSet
+	Groupdefs groupdefsSource
+	DenyRules []denyRule
+	Routes    []route
+	Rollouts  rolloutSource
+}
+
+// options is the options section of the config
+type options struct {
+	HTTPS                 bool
+	Port                  int
+	Endpoint              string
+	Logfile               string
+	HashCost              int
+	FingerprintSecret     string
+	MatchRawServicetokens bool
+	OverrideDiscovery     bool
+	Maintenance           maintenanceSource
+	MaintenanceBypass     bypassOptions
+	Bans                  banSource
+	IPBans                ipBanSource
+	TrustedProxies        []*net.IPNet
+	ProxyProtocol         bool
+	HealthCheck           *healthCheckOptions
+	Status                statusOptions
+	Webhook               webhookOptions
+	Cache                 cacheOptions
+	ReloadOnChange        bool
+}
+
+// the keys of the options section
+var optionKeys = []string{"https", "port", "endpoint", "logfile", "hashCost", "fingerprintSecret", "matchRawServicetokens", "overrideDiscovery", "maintenance", "maintenanceBypass", "bans", "ipBans", "trustedProxies", "proxyProtocol", "healthCheck", "status", "webhook", "cache", "reloadOnChange"}
+
+// cacheOptions holds how long (in seconds) to wait between
+// each update of the data that is pulled from a url, and where
+// the last good copy of it is kept
+type cacheOptions struct {
+	MaintenanceTimeout int
+	BanlistTimeout     int
+	IPBansTimeout      int
+	GroupdefsTimeout   int
+	RolloutsTimeout    int
+	Directory          string
+	WaitForData        bool
+	Fetch              fetchOptions
+}
+
+// endpointSet is a group of endpoints that clients are sent to. each
+// endpoint can be served by several hosts
+type endpointSet struct {
+	Discovery hostPool
+	API       hostPool
+	WiiU      hostPool
+	N3DS      hostPool
+	Sticky    bool
+	Fallback  string
+}
+
+// ban is a single entry in the banlist. bans without an expiry are permanent
+type ban struct {
+	Reason  string     `json:"reason"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Issued  *time.Time `json:"issued,omitempty"`
+	Issuer  string     `json:"issuer,omitempty"`
+}
+
+// remoteSource is a url that data is pulled from, along with how to authenticate to it
+// and the keys its data has to be signed with, or a local file that is watched for changes
+type remoteSource struct {
+	URL             string
+	File            string
+	Headers         map[string]string
+	Username        string
+	Password        string
+	TLS             *tls.Config
+	PublicKeys      []ed25519.PublicKey
+	SignatureHeader string
+	SignatureMaxAge int
+}
+
+// maintenanceSource is either a url to pull the maintenance status from, or the status itself
+type maintenanceSource struct {
+	remoteSource
+	Status maintenanceStatus
+}
+
+// banSource is either a url to pull the banlist from, or the banlist itself
+type banSource struct {
+	remoteSource
+	Bans map[string]ban
+}
+
+// ipBanSource is either a url to pull the ip bans from, or the ip bans themselves
+type ipBanSource struct {
+	remoteSource
+	Bans []ipBan
+}
+
+// groupdefsSource is either a url to pull the groupdefs from, or the groupdefs themselves
+type groupdefsSource struct {
+	remoteSource
+	Groupdefs map[string]string
+}
+
+// rolloutSource is either a url to pull the rollouts from, or the rollouts themselves
+type rolloutSource struct {
+	remoteSource
+	Rollouts []rollout
+}
+
+// configError is a single problem found in the config
+type configError struct {
+	Path    string
+	Line    int
+	Message string
+}
+
+// Error formats the problem along with where it is
+func (e configError) Error() string {
+
+	return fmt.Sprintf("line %d: %s: %s", e.Line, e.Path, e.Message)
+
+}
+
+// configErrors is every problem found in the config
+type configErrors []configError
+
+// Error joins all of the problems together, one per line
+func (e configErrors) Error() string {
+
+	// the formatted problems
+	lines := make([]string, len(e))
+
+	// format each of them
+	for i, problem := range e {
+
+		lines[i] = problem.Error()
+
+	}
+
+	return strings.Join(lines, "\n")
+
+}
+
+// configDecoder walks a yaml document and collects every problem in it
+// instead of stopping at the first one
+type configDecoder struct {
+	errors   configErrors
+	groups   map[string]endpointSet
+	deferred []func()
+	fromEnv  map[*yaml.Node]bool
+}
+
+// later runs a check once the whole config has been decoded
+func (d *configDecoder) later(check func()) {
+
+	d.deferred = append(d.deferred, check)
+
+}
+
+// the friendly names of the yaml tags we report on
+var tagNames = map[string]string{
+	"!!str":   "string",
+	"!!int":   "integer",
+	"!!bool":  "boolean",
+	"!!float": "float",
+	"!!null":  "null",
+	"!!map":   "mapping",
+	"!!seq":   "list",
+}
+
+// joinPath appends a key to a yaml path
+func joinPath(path, key string) string {
+
+	// the root has no prefix
+	if path == "" {
+
+		return key
+
+	}
+
+	return path + "." + key
+
+}
+
+// describe returns the friendly name of the type of a node
+func describe(node *yaml.Node) string {
+
+	// check if we have a name for it
+	if name, ok := tagNames[node.ShortTag()]; ok {
+
+		return name
+
+	}
+
+	return node.ShortTag()
+
+}
+
+// fail records a problem at the given node
+func (d *configDecoder) fail(node *yaml.Node, path, format string, args ...interface{}) {
+
+	d.errors = append(d.errors, configError{
+		Path:    path,
+		Line:    node.Line,
+		Message: fmt.Sprintf(format, args...),
+	})
+
+}
+
+// expect checks that a node has the given tag, and records a problem if it doesn't
+func (d *configDecoder) expect(node *yaml.Node, path, tag string) bool {
+
+	// check the tag
+	if node.ShortTag() != tag {
+
+		d.fail(node, path, "expected %s, got %s", tagNames[tag], describe(node))
+		return false
+
+	}
+
+	return true
+
+}
+
+// entries calls fn with each key and value of a mapping node, in order
+func (d *configDecoder) entries(node *yaml.Node, path string, fn func(key string, value *yaml.Node)) {
+
+	// make sure it's a mapping
+	if !d.expect(node, path, "!!map") {
+
+		return
+
+	}
+
+	// mapping nodes alternate between keys and values
+	for i := 0; i+1 < len(node.Content); i += 2 {
+
+		fn(node.Content[i].Value, node.Content[i+1])
+
+	}
+
+}
+
+// items calls fn with the index and value of each item of a list node, in order
+func (d *configDecoder) items(node *yaml.Node, path string, fn func(index int, path string, value *yaml.Node)) {
+
+	// make sure it's a list
+	if !d.expect(node, path, "!!seq") {
+
+		return
+
+	}
+
+	// go over each item
+	for i, item := range node.Content {
+
+		fn(i, fmt.Sprintf("%s[%d]", path, i), item)
+
+	}
+
+}
+
+// fields returns the values of a mapping node by key, and records a problem for
+// every key that isn't one of the known ones (which is almost always a typo)
+func (d *configDecoder) fields(node *yaml.Node, path string, known ...string) map[string]*yaml.Node {
+
+	// the values we found
+	values := map[string]*yaml.Node{}
+
+	// go over each key
+	d.entries(node, path, func(key string, value *yaml.Node) {
+
+		// check that we know about it
+		for _, name := range known {
+
+			if key == name {
+
+				values[key] = value
+				return
+
+			}
+
+		}
+
+		d.fail(value, joinPath(path, key), "unknown key (expected one of %s)", strings.Join(known, ", "))
+
+	})
+
+	return values
+
+}
+
+// require returns the value of a key that has to be present, recording a problem if it isn't
+func (d *configDecoder) require(values map[string]*yaml.Node, parent *yaml.Node, path, key string) *yaml.Node {
+
+	// check if it's there
+	value, ok := values[key]
+	if !ok {
+
+		d.fail(parent, joinPath(path, key), "missing required key")
+		return nil
+
+	}
+
+	return value
+
+}
+
+// str decodes a string scalar
+func (d *configDecoder) str(node *yaml.Node, path string) string {
+
+	// values from the environment can be read as strings whatever they look like
+	if node != nil && node.Kind == yaml.ScalarNode && d.fromEnv[node] {
+
+		return node.Value
+
+	}
+
+	// a missing value has already been reported
+	if node == nil || !d.expect(node, path, "!!str") {
+
+		return ""
+
+	}
+
+	return node.Value
+
+}
+
+// integer decodes an integer scalar
+func (d *configDecoder) integer(node *yaml.Node, path string) int {
+
+	// the decoded value
+	var value int
+
+	// a missing value has already been reported
+	if node == nil || !d.expect(node, path, "!!int") {
+
+		return 0
+
+	}
+
+	// decode it
+	if err := node.Decode(&value); err != nil {
+
+		d.fail(node, path, "invalid integer: %v", err)
+
+	}
+
+	return value
+
+}
+
+// boolean decodes a boolean scalar
+func (d *configDecoder) boolean(node *yaml.Node, path string) bool {
+
+	// the decoded value
+	var value bool
+
+	// a missing value has already been reported
+	if node == nil || !d.expect(node, path, "!!bool") {
+
+		return false
+
+	}
+
+	// decode it
+	if err := node.Decode(&value); err != nil {
+
+		d.fail(node, path, "invalid boolean: %v", err)
+
+	}
+
+	return value
+
+}
+
+// scalars decodes either a single scalar or a list of them into strings
+func (d *configDecoder) scalars(node *yaml.Node, path string) []string {
+
+	// the decoded values
+	values := []string{}
+
+	// a single one is the same as a list of one
+	if node.Kind == yaml.ScalarNode && node.ShortTag() != "!!null" {
+
+		return append(values, node.Value)
+
+	}
+
+	// otherwise, decode each of them
+	d.items(node, path, func(_ int, path string, item *yaml.Node) {
+
+		if item.Kind != yaml.ScalarNode || item.ShortTag() == "!!null" {
+
+			d.fail(item, path, "expected a string or a number, got %s", describe(item))
+			return
+
+		}
+
+		values = append(values, item.Value)
+
+	})
+
+	return values
+
+}
+
+// number decodes an integer or float scalar
+func (d *configDecoder) number(node *yaml.Node, path string) float64 {
+
+	// the decoded value
+	var value float64
+
+	// a missing value has already been reported
+	if node == nil {
+
+		return 0
+
+	}
+
+	// it can be either
+	if node.ShortTag() != "!!int" && node.ShortTag() != "!!float" {
+
+		d.fail(node, path, "expected number, got %s", describe(node))
+		return 0
+
+	}
+
+	// decode it
+	if err := node.Decode(&value); err != nil {
+
+		d.fail(node, path, "invalid number: %v", err)
+
+	}
+
+	return value
+
+}
+
+// timestamp decodes a timestamp, written either as a yaml timestamp or as an rfc 3339 string
+func (d *configDecoder) timestamp(node *yaml.Node, path string) *time.Time {
+
+	// the decoded value
+	var value time.Time
+
+	// a missing value has already been reported
+	if node == nil {
+
+		return nil
+
+	}
+
+	switch node.ShortTag() {
+
+	case "!!timestamp":
+		// yaml already knows how to decode these
+		if err := node.Decode(&value); err != nil {
+
+			d.fail(node, path, "invalid timestamp: %v", err)
+			return nil
+
+		}
+
+	case "!!str":
+		// parse it ourselves
+		parsed, err := time.Parse(time.RFC3339, node.Value)
+		if err != nil {
+
+			d.fail(node, path, "invalid timestamp (expected something like 2006-01-02T15:04:05Z): %v", err)
+			return nil
+
+		}
+		value = parsed
+
+	default:
+		d.fail(node, path, "expected timestamp, got %s", describe(node))
+		return nil
+
+	}
+
+	return &value
+
+}
+
+// positive decodes an optional integer that must be above zero, falling back to a default
+func (d *configDecoder) positive(node *yaml.Node, path string, fallback int) int {
+
+	// use the default if it isn't there
+	if node == nil {
+
+		return fallback
+
+	}
+
+	// decode it
+	value := d.integer(node, path)
+	if value <= 0 && node.ShortTag() == "!!int" {
+
+		d.fail(node, path, "must be greater than zero")
+
+	}
+
+	return value
+
+}
+
+// isSource checks if a node is a url or a file that data is read from, which is either
+// written as a string (file:// for files), or as a mapping with a url and how to
+// authenticate to it, or a file
+func isSource(node *yaml.Node) bool {
+
+	// a string is just the url, or the file
+	if node.ShortTag() == "!!str" {
+
+		return true
+
+	}
+
+	// otherwise, look for the url or the file
+	if node.ShortTag() == "!!map" {
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+
+			if node.Content[i].Value == "url" || node.Content[i].Value == "file" {
+
+				return true
+
+			}
+
+		}
+
+	}
+
+	return false
+
+}
+
+// source decodes a url that data is pulled from, or a file that it's read from
+func (d *configDecoder) source(node *yaml.Node, path string) remoteSource {
+
+	// the decoded source
+	source := remoteSource{Headers: map[string]string{}}
+
+	// a string is just the url, or the file
+	if node.ShortTag() == "!!str" {
+
+		if strings.HasPrefix(node.Value, "file://") {
+
+			source.File = d.sourceFile(node, path, strings.TrimPrefix(node.Value, "file://"))
+			return source
+
+		}
+
+		source.URL = d.sourceURL(node, path, node.Value)
+		return source
+
+	}
+
+	// get the fields
+	values := d.fields(node, path, "url", "file", "headers", "bearerToken", "basicAuth", "caFile", "certFile", "keyFile", "publicKeys", "signatureHeader", "signatureMaxAge")
+
+	// files only have the path
+	if value, ok := values["file"]; ok {
+
+		if len(values) != 1 {
+
+			d.fail(node, path, "a file can't be combined with anything else")
+
+		}
+		source.File = d.sourceFile(value, joinPath(path, "file"), d.str(value, joinPath(path, "file")))
+		return source
+
+	}
+
+	// decode them
+	source.URL = d.sourceURL(values["url"], joinPath(path, "url"), d.str(values["url"], joinPath(path, "url")))
+	if value, ok := values["headers"]; ok {
+
+		d.entries(value, joinPath(path, "headers"), func(key string, header *yaml.Node) {
+
+			source.Headers[key] = d.secret(header, joinPath(joinPath(path, "headers"), key))
+
+		})
+
+	}
+	if value, ok := values["bearerToken"]; ok {
+
+		source.Headers["Authorization"] = "Bearer " + d.secret(value, joinPath(path, "bearerToken"))
+
+	}
+	if value, ok := values["basicAuth"]; ok {
+
+		auth := d.fields(value, joinPath(path, "basicAuth"), "username", "password")
+		if value.ShortTag() == "!!map" {
+
+			source.Username = d.secret(d.require(auth, value, joinPath(path, "basicAuth"), "username"), joinPath(path, "basicAuth.username"))
+			source.Password = d.secret(d.require(auth, value, joinPath(path, "basicAuth"), "password"), joinPath(path, "basicAuth.password"))
+
+		}
+
+	}
+
+	// the data has to be signed if there are any keys to check it with
+	source.SignatureHeader = defaultSignatureHeader
+	if value, ok := values["publicKeys"]; ok {
+
+		for i, key := range d.scalars(value, joinPath(path, "publicKeys")) {
+
+			// parse the key
+			publicKey, err := parsePublicKey(key)
+			if err != nil {
+
+				d.fail(value, fmt.Sprintf("%s[%d]", joinPath(path, "publicKeys"), i), "invalid ed25519 public key: %v", err)
+				continue
+
+			}
+
+			source.PublicKeys = append(source.PublicKeys, publicKey)
+
+		}
+
+	}
+	if value, ok := values["signatureHeader"]; ok {
+
+		source.SignatureHeader = d.str(value, joinPath(path, "signatureHeader"))
+
+	}
+
+	// data signed longer ago than this is refused
+	if value, ok := values["signatureMaxAge"]; ok {
+
+		source.SignatureMaxAge = d.positive(value, joinPath(path, "signatureMaxAge"), 0)
+		if values["publicKeys"] == nil {
+
+			d.fail(value, joinPath(path, "signatureMaxAge"), "only used with publicKeys")
+
+		}
+
+	}
+
+	// only build a tls config if something in it is changed
+	if values["caFile"] == nil && values["certFile"] == nil && values["keyFile"] == nil {
+
+		return source
+
+	}
+	source.TLS = &tls.Config{}
+
+	// a ca bundle replaces the system's certificate authorities
+	if value, ok := values["caFile"]; ok {
+
+		file := d.str(value, joinPath(path, "caFile"))
+		if data, err := readFileByte(file); err != nil {
+
+			d.fail(value, joinPath(path, "caFile"), "%v", err)
+
+		} else {
+
+			source.TLS.RootCAs = x509.NewCertPool()
+			if !source.TLS.RootCAs.AppendCertsFromPEM(data) {
+
+				d.fail(value, joinPath(path, "caFile"), "no pem-encoded certificates in %s", file)
+
+			}
+
+		}
+
+	}
+
+	// client certificates need both a certificate and a key
+	if values["certFile"] != nil || values["keyFile"] != nil {
+
+		certFile := d.str(d.require(values, node, path, "certFile"), joinPath(path, "certFile"))
+		keyFile := d.str(d.require(values, node, path, "keyFile"), joinPath(path, "keyFile"))
+		if certFile != "" && keyFile != "" {
+
+			certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+
+				d.fail(node, path, "unable to load the client certificate: %v", err)
+
+			} else {
+
+				source.TLS.Certificates = []tls.Certificate{certificate}
+
+			}
+
+		}
+
+	}
+
+	return source
+
+}
+
+// sourceURL checks the url that data is pulled from
+func (d *configDecoder) sourceURL(node *yaml.Node, path, address string) string {
+
+	// a missing value has already been reported
+	if node == nil || node.ShortTag() != "!!str" {
+
+		return address
+
+	}
+
+	// it has to be an absolute http or https url
+	parsed, err := url.Parse(address)
+	if err != nil {
+
+		d.fail(node, path, "invalid url: %v", err)
+
+	} else if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+
+		d.fail(node, path, "expected an http or https url, got %q", address)
+
+	}
+
+	return address
+
+}
+
+// sourceFile checks the path of a file that data is read from
+func (d *configDecoder) sourceFile(node *yaml.Node, path, file string) string {
+
+	// it has to be there
+	if file == "" {
+
+		d.fail(node, path, "must not be empty")
+
+	} else if _, err := os.Stat(file); err != nil {
+
+		d.fail(node, path, "%v", err)
+
+	}
+
+	return file
+
+}
+
+// tokenKey checks that a servicetoken in the bans, the groupdefs or the allowlist is a
+// fingerprint or a hexadecimal-encoded bcrypt hash, which is all they can be matched by
+func (d *configDecoder) tokenKey(node *yaml.Node, path, key string) bool {
+
+	if !isFingerprint(key) && !isHash(key) {
+
+		d.fail(node, path, "expected a fingerprint or a hexadecimal-encoded hash")
+		return false
+
+	}
+
+	return true
+
+}
+
+// secret decodes a value that is either written out, or read from an environment
+// variable ({ env: NAME }) or a file ({ file: path }) so it doesn't have to be in the config
+func (d *configDecoder) secret(node *yaml.Node, path string) string {
+
+	// a missing value has already been reported
+	if node == nil {
+
+		return ""
+
+	}
+
+	// anything but a mapping is written out
+	if node.ShortTag() != "!!map" {
+
+		return d.str(node, path)
+
+	}
+
+	// get the fields
+	values := d.fields(node, path, "env", "file")
+	if (values["env"] == nil) == (values["file"] == nil) {
+
+		d.fail(node, path, "expected either env or file")
+		return ""
+
+	}
+
+	// read it from the environment
+	if value, ok := values["env"]; ok {
+
+		name := d.str(value, joinPath(path, "env"))
+		secret, ok := os.LookupEnv(name)
+		if !ok && value.ShortTag() == "!!str" {
+
+			d.fail(value, joinPath(path, "env"), "environment variable %s is not set", name)
+
+		}
+		return secret
+
+	}
+
+	// or from a file, without the line ending most editors leave
+	file := d.str(values["file"], joinPath(path, "file"))
+	data, err := readFileByte(file)
+	if err != nil {
+
+		d.fail(values["file"], joinPath(path, "file"), "%v", err)
+		return ""
+
+	}
+
+	return strings.TrimRight(string(data), "\r\n")
+
+}
+
+// loadConfig reads, parses and validates a config file
+func loadConfig(file string) (*configuration, error) {
+
+	// get the file data
+	confByte, err := readFileByte(file)
+
+	// check for errors
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	// parse and validate it
+	return parseConfig(confByte)
+
+}
+
+// reportConfigError shows why a config file couldn't be loaded
+func reportConfigError(out io.Writer, file string, err error) {
+
+	switch err := err.(type) {
+
+	case configErrors:
+		// show every problem
+		fmt.Fprintf(out, "[err]: there are problems with your %s...\n", file)
+		for _, problem := range err {
+
+			fmt.Fprintf(out, "       %v\n", problem)
+
+		}
+
+	case *os.PathError:
+		// the file couldn't be read
+		fmt.Fprintf(out, "[err]: error while loading %s.\n", file)
+		fmt.Fprintf(out, "       you should copy config.example.yaml to %s and edit it.\n", file)
+
+	default:
+		// the yaml itself is broken
+		fmt.Fprintf(out, "[err]: there is an error in your yaml in %s...\n", file)
+		fmt.Fprintf(out, "       %v\n", err)
+
+	}
+
+}
+
+// parseConfig parses and validates the config, returning every problem found in it
+func parseConfig(data []byte) (*configuration, error) {
+
+	// the parsed document
+	var document yaml.Node
+
+	// parse it
+	if err := yaml.Unmarshal(data, &document); err != nil {
+
+		return nil, err
+
+	}
+
+	// an empty file has no content
+	if len(document.Content) == 0 {
+
+		return nil, configErrors{{Path: "(root)", Line: 1, Message: "the config is empty"}}
+
+	}
+
+	// fill it in from the environment
+	decoder := &configDecoder{fromEnv: map[*yaml.Node]bool{}}
+	decoder.substituteEnv(document.Content[0], "")
+	decoder.overrideOptions(document.Content[0])
+
+	// decode it
+	config := decoder.config(document.Content[0])
+
+	// run the checks that needed the whole config
+	for _, check := range decoder.deferred {
+
+		check()
+
+	}
+
+	// check if anything went wrong
+	if len(decoder.errors) != 0 {
+
+		// report them in the order they appear in the file
+		sort.SliceStable(decoder.errors, func(i, j int) bool {
+
+			return decoder.errors[i].Line < decoder.errors[j].Line
+
+		})
+
+		return nil, decoder.errors
+
+	}
+
+	return config, nil
+
+}
+
+// config decodes the root of the config
+func (d *configDecoder) config(node *yaml.Node) *configuration {
+
+	// the decoded config
+	config := &configuration{}
+
+	// get the sections
+	values := d.fields(node, "", "options", "endpoints", "groupdefs", "denyRules", "routes", "rollouts")
+
+	// decode them
+	if value := d.require(values, node, "", "options"); value != nil {
+
+		config.Options = d.options(value, "options")
+
+	}
+	if value := d.require(values, node, "", "endpoints"); value != nil {
+
+		config.Endpoints = d.endpoints(value, "endpoints", config.Options.OverrideDiscovery)
+		d.groups = config.Endpoints
+
+	}
+	if value, ok := values["groupdefs"]; ok {
+
+		config.Groupdefs = d.groupdefs(value, "groupdefs", config.Endpoints)
+
+	}
+	if value, ok := values["denyRules"]; ok {
+
+		d.items(value, "denyRules", func(_ int, path string, item *yaml.Node) {
+
+			config.DenyRules = append(config.DenyRules, d.denyRule(item, path))
+
+		})
+
+	}
+	if value, ok := values["routes"]; ok {
+
+		d.items(value, "routes", func(_ int, path string, item *yaml.Node) {
+
+			config.Routes = append(config.Routes, d.route(item, path, config.Endpoints))
+
+		})
+
+	}
+	config.Rollouts.Rollouts = []rollout{}
+	if value, ok := values["rollouts"]; ok {
+
+		switch {
+
+		case isSource(value):
+			config.Rollouts.remoteSource = d.source(value, "rollouts")
+
+		case value.ShortTag() == "!!null":
+
+		default:
+			d.items(value, "rollouts", func(_ int, path string, item *yaml.Node) {
+
+				config.Rollouts.Rollouts = append(config.Rollouts.Rollouts, d.rollout(item, path, config.Endpoints))
+
+			})
+
+		}
+
+	}
+
+	return config
+
+}
+
+// options decodes the options section
+func (d *configDecoder) options(node *yaml.Node, path string) options {
+
+	// the decoded options
+	settings := options{}
+
+	// get the fields
+	values := d.fields(node, path, optionKeys...)
+
+	// decode them
+	settings.HTTPS = d.boolean(d.require(values, node, path, "https"), joinPath(path, "https"))
+	settings.Port = d.integer(d.require(values, node, path, "port"), joinPath(path, "port"))
+	settings.Endpoint = d.str(d.require(values, node, path, "endpoint"), joinPath(path, "endpoint"))
+	settings.Logfile = d.str(d.require(values, node, path, "logfile"), joinPath(path, "logfile"))
+	settings.HashCost = d.integer(d.require(values, node, path, "hashCost"), joinPath(path, "hashCost"))
+	settings.OverrideDiscovery = d.boolean(d.require(values, node, path, "overrideDiscovery"), joinPath(path, "overrideDiscovery"))
+
+	// the fingerprint secret is optional
+	if value, ok := values["fingerprintSecret"]; ok {
+
+		settings.FingerprintSecret = d.str(value, joinPath(path, "fingerprintSecret"))
+		if value.ShortTag() == "!!str" && len(settings.FingerprintSecret) < 16 {
+
+			d.fail(value, joinPath(path, "fingerprintSecret"), "must be at least 16 characters long")
+
+		}
+
+	}
+
+	// matching legacy entries against the raw header is on unless turned off
+	settings.MatchRawServicetokens = true
+	if value, ok := values["matchRawServicetokens"]; ok {
+
+		settings.MatchRawServicetokens = d.boolean(value, joinPath(path, "matchRawServicetokens"))
+
+	}
+
+	// the config is only reloaded on SIGHUP unless asked to
+	if value, ok := values["reloadOnChange"]; ok {
+
+		settings.ReloadOnChange = d.boolean(value, joinPath(path, "reloadOnChange"))
+
+	}
+
+	// check that they make sense
+	if value := values["port"]; value != nil && value.ShortTag() == "!!int" && (settings.Port < 1 || settings.Port > 65535) {
+
+		d.fail(value, joinPath(path, "port"), "must be between 1 and 65535")
+
+	}
+	if value := values["endpoint"]; value != nil && value.ShortTag() == "!!str" && !strings.HasPrefix(settings.Endpoint, "/") {
+
+		d.fail(value, joinPath(path, "endpoint"), "must start with a /")
+
+	}
+	if value := values["hashCost"]; value != nil && value.ShortTag() == "!!int" && (settings.HashCost < bcrypt.MinCost || settings.HashCost > bcrypt.MaxCost) {
+
+		d.fail(value, joinPath(path, "hashCost"), "must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+
+	}
+
+	// maintenance is either a url, a boolean or a status with scopes
+	if value := d.require(values, node, path, "maintenance"); value != nil {
+
+		switch {
+
+		case isSource(value):
+			settings.Maintenance.remoteSource = d.source(value, joinPath(path, "maintenance"))
+
+		case value.ShortTag() == "!!map":
+			settings.Maintenance.Status = d.maintenance(value, joinPath(path, "maintenance"))
+
+		default:
+			settings.Maintenance.Status.InMaintenance = d.boolean(value, joinPath(path, "maintenance"))
+
+		}
+
+	}
+
+	// bans are either a url, a map of bans or nothing at all
+	settings.Bans.Bans = map[string]ban{}
+	if value, ok := values["bans"]; ok {
+
+		switch {
+
+		case isSource(value):
+			settings.Bans.remoteSource = d.source(value, joinPath(path, "bans"))
+
+		case value.ShortTag() == "!!null":
+
+		default:
+			d.entries(value, joinPath(path, "bans"), func(key string, entry *yaml.Node) {
+
+				if d.tokenKey(entry, joinPath(joinPath(path, "bans"), key), key) {
+
+					settings.Bans.Bans[key] = d.ban(entry, joinPath(joinPath(path, "bans"), key))
+
+				}
+
+			})
+
+		}
+
+	}
+
+	// ip bans are either a url, a map of banned networks or nothing at all
+	settings.IPBans.Bans = []ipBan{}
+	if value, ok := values["ipBans"]; ok {
+
+		switch {
+
+		case isSource(value):
+			settings.IPBans.remoteSource = d.source(value, joinPath(path, "ipBans"))
+
+		case value.ShortTag() == "!!null":
+
+		default:
+			d.entries(value, joinPath(path, "ipBans"), func(key string, entry *yaml.Node) {
+
+				// parse the network
+				network, err := parseNetwork(key)
+				if err != nil {
+
+					d.fail(entry, joinPath(joinPath(path, "ipBans"), key), "%v", err)
+					return
+
+				}
+
+				settings.IPBans.Bans = append(settings.IPBans.Bans, newIPBan(network, d.ipBan(entry, joinPath(joinPath(path, "ipBans"), key))))
+
+			})
+
+		}
+
+	}
+
+	// forwarded addresses are only believed from trusted proxies
+	settings.TrustedProxies = []*net.IPNet{}
+	if value, ok := values["trustedProxies"]; ok {
+
+		for i, address := range d.scalars(value, joinPath(path, "trustedProxies")) {
+
+			// parse the network
+			network, err := parseNetwork(address)
+			if err != nil {
+
+				d.fail(value, fmt.Sprintf("%s[%d]", joinPath(path, "trustedProxies"), i), "%v", err)
+				continue
+
+			}
+
+			settings.TrustedProxies = append(settings.TrustedProxies, network)
+
+		}
+
+	}
+	if value, ok := values["proxyProtocol"]; ok {
+
+		settings.ProxyProtocol = d.boolean(value, joinPath(path, "proxyProtocol"))
+
+		// without trusted proxies, every connection would be refused
+		if settings.ProxyProtocol == true && len(settings.TrustedProxies) == 0 {
+
+			d.fail(value, joinPath(path, "proxyProtocol"), "needs trustedProxies to be set")
+
+		}
+
+	}
+
+	// so is the maintenance bypass allowlist
+	if value, ok := values["maintenanceBypass"]; ok {
+
+		settings.MaintenanceBypass = d.maintenanceBypass(value, joinPath(path, "maintenanceBypass"))
+
+	}
+
+	// health checks are only done if they're configured
+	if value, ok := values["healthCheck"]; ok {
+
+		healthCheck := d.healthCheck(value, joinPath(path, "healthCheck"))
+		settings.HealthCheck = &healthCheck
+
+	}
+
+	// so is the status endpoint
+	if value, ok := values["status"]; ok {
+
+		settings.Status = d.status(value, joinPath(path, "status"), settings.Endpoint)
+
+	}
+
+	// and so is the webhook
+	if value, ok := values["webhook"]; ok {
+
+		settings.Webhook = d.webhook(value, joinPath(path, "webhook"), settings.Endpoint)
+
+	}
+
+	// the cache section is optional
+	if value, ok := values["cache"]; ok {
+
+		settings.Cache = d.cache(value, joinPath(path, "cache"))
+
+	} else {
+
+		settings.Cache = d.cache(nil, joinPath(path, "cache"))
+
+	}
+
+	return settings
+
+}
+
+// ban decodes a single ban
+func (d *configDecoder) ban(node *yaml.Node, path string) ban {
+
+	// get the fields
+	values := d.fields(node, path, "reason", "expires", "issued", "issuer")
+
+	// decode them
+	entry := ban{
+		Reason:  d.str(d.require(values, node, path, "reason"), joinPath(path, "reason")),
+		Expires: d.timestamp(values["expires"], joinPath(path, "expires")),
+		Issued:  d.timestamp(values["issued"], joinPath(path, "issued")),
+	}
+	if value, ok := values["issuer"]; ok {
+
+		entry.Issuer = d.str(value, joinPath(path, "issuer"))
+
+	}
+
+	return entry
+
+}
+
+// ipBan decodes a single ip ban
+func (d *configDecoder) ipBan(node *yaml.Node, path string) ipBanEntry {
+
+	// the decoded entry
+	entry := ipBanEntry{}
+
+	// get the fields
+	values := d.fields(node, path, "reason", "code", "errorCode")
+
+	// decode them
+	entry.Reason = d.str(d.require(values, node, path, "reason"), joinPath(path, "reason"))
+	if value, ok := values["code"]; ok {
+
+		entry.Code = d.positive(value, joinPath(path, "code"), 400)
+
+	}
+	if value, ok := values["errorCode"]; ok {
+
+		entry.ErrorCode = d.positive(value, joinPath(path, "errorCode"), 7)
+
+	}
+
+	return entry
+
+}
+
+// healthCheck decodes the healthCheck section
+func (d *configDecoder) healthCheck(node *yaml.Node, path string) healthCheckOptions {
+
+	// get the fields
+	values := d.fields(node, path, "type", "path", "https", "port", "interval", "timeout", "failures")
+
+	// the decoded section
+	settings := healthCheckOptions{
+		Type:     "tcp",
+		Path:     "/",
+		Interval: d.positive(values["interval"], joinPath(path, "interval"), 10),
+		Timeout:  d.positive(values["timeout"], joinPath(path, "timeout"), 5),
+		Failures: d.positive(values["failures"], joinPath(path, "failures"), 3),
+	}
+
+	// decode the rest
+	if value, ok := values["type"]; ok {
+
+		settings.Type = d.str(value, joinPath(path, "type"))
+		if value.ShortTag() == "!!str" && settings.Type != "tcp" && settings.Type != "http" {
+
+			d.fail(value, joinPath(path, "type"), "must be either tcp or http")
+
+		}
+
+	}
+	if value, ok := values["path"]; ok {
+
+		settings.Path = d.str(value, joinPath(path, "path"))
+		if value.ShortTag() == "!!str" && !strings.HasPrefix(settings.Path, "/") {
+
+			d.fail(value, joinPath(path, "path"), "must start with a /")
+
+		}
+
+	}
+	if value, ok := values["https"]; ok {
+
+		settings.HTTPS = d.boolean(value, joinPath(path, "https"))
+
+	}
+
+	// the port depends on what we're checking
+	settings.Port = 80
+	if settings.HTTPS || settings.Type == "tcp" {
+
+		settings.Port = 443
+
+	}
+	if value, ok := values["port"]; ok {
+
+		settings.Port = d.positive(value, joinPath(path, "port"), settings.Port)
+
+	}
+
+	return settings
+
+}
+
+// status decodes the status section
+func (d *configDecoder) status(node *yaml.Node, path, discoveryEndpoint string) statusOptions {
+
+	// get the fields
+	values := d.fields(node, path, "endpoint", "token")
+
+	// decode them
+	settings := statusOptions{
+		Endpoint: d.str(d.require(values, node, path, "endpoint"), joinPath(path, "endpoint")),
+	}
+	if value, ok := values["token"]; ok {
+
+		settings.Token = d.str(value, joinPath(path, "token"))
+
+	}
+
+	// check that it makes sense
+	if value := values["endpoint"]; value != nil && value.ShortTag() == "!!str" {
+
+		if !strings.HasPrefix(settings.Endpoint, "/") {
+
+			d.fail(value, joinPath(path, "endpoint"), "must start with a /")
+
+		} else if settings.Endpoint == discoveryEndpoint {
+
+			d.fail(value, joinPath(path, "endpoint"), "must be different from options.endpoint")
+
+		}
+
+	}
+
+	return settings
+
+}
+
+// webhook decodes the webhook section
+func (d *configDecoder) webhook(node *yaml.Node, path, discoveryEndpoint string) webhookOptions {
+
+	// get the fields
+	values := d.fields(node, path, "endpoint", "secret", "maxSkew")
+
+	// decode them
+	settings := webhookOptions{
+		Endpoint: d.str(d.require(values, node, path, "endpoint"), joinPath(path, "endpoint")),
+		Secret:   d.secret(d.require(values, node, path, "secret"), joinPath(path, "secret")),
+		MaxSkew:  d.positive(values["maxSkew"], joinPath(path, "maxSkew"), 300),
+	}
+
+	// check that it makes sense
+	if value := values["endpoint"]; value != nil && value.ShortTag() == "!!str" {
+
+		if !strings.HasPrefix(settings.Endpoint, "/") {
+
+			d.fail(value, joinPath(path, "endpoint"), "must start with a /")
+
+		} else if settings.Endpoint == discoveryEndpoint {
+
+			d.fail(value, joinPath(path, "endpoint"), "must be different from options.endpoint")
+
+		}
+
+	}
+	if value := values["secret"]; value != nil && settings.Secret == "" {
+
+		d.fail(value, joinPath(path, "secret"), "must not be empty")
+
+	}
+
+	return settings
+
+}
+
+// maintenance decodes a maintenance status with a message, scopes and windows
+func (d *configDecoder) maintenance(node *yaml.Node, path string) maintenanceStatus {
+
+	// get the fields
+	values := d.fields(node, path, "inMaintenance", "message", "scopes", "windows")
+
+	// the decoded status
+	status := maintenanceStatus{Scopes: []maintenanceScope{}, Windows: []maintenanceWindow{}}
+
+	// decode them
+	if value, ok := values["inMaintenance"]; ok {
+
+		status.InMaintenance = d.boolean(value, joinPath(path, "inMaintenance"))
+
+	}
+	if value, ok := values["message"]; ok {
+
+		status.Message = d.str(value, joinPath(path, "message"))
+
+	}
+	if value, ok := values["scopes"]; ok {
+
+		d.items(value, joinPath(path, "scopes"), func(_ int, path string, item *yaml.Node) {
+
+			status.Scopes = append(status.Scopes, d.maintenanceScope(item, path))
+
+		})
+
+	}
+	if value, ok := values["windows"]; ok {
+
+		d.items(value, joinPath(path, "windows"), func(_ int, path string, item *yaml.Node) {
+
+			if window, ok := d.maintenanceWindow(item, path); ok {
+
+				status.Windows = append(status.Windows, window)
+
+			}
+
+		})
+
+	}
+
+	return status
+
+}
+
+// maintenanceScope decodes a single maintenance scope
+func (d *configDecoder) maintenanceScope(node *yaml.Node, path string) maintenanceScope {
+
+	// get the fields
+	values := d.fields(node, path, "group", "match", "except", "message")
+
+	// decode them
+	scope := d.scope(values, path)
+
+	// a scope that matches everything would be the same as inMaintenance
+	if node.ShortTag() == "!!map" && values["group"] == nil && values["match"] == nil && values["except"] == nil {
+
+		d.fail(node, path, "a scope needs a group, match or except")
+
+	}
+
+	return scope
+
+}
+
+// maintenanceWindow decodes a single scheduled maintenance window
+func (d *configDecoder) maintenanceWindow(node *yaml.Node, path string) (maintenanceWindow, bool) {
+
+	// get the fields
+	values := d.fields(node, path, "start", "end", "cron", "duration", "timezone", "group", "match", "except", "message")
+
+	// decode them
+	scope := d.scope(values, path)
+	var start, end *time.Time
+	var cron, duration, timezone string
+	if value, ok := values["start"]; ok {
+
+		start = d.timestamp(value, joinPath(path, "start"))
+
+	}
+	if value, ok := values["end"]; ok {
+
+		end = d.timestamp(value, joinPath(path, "end"))
+
+	}
+	if value, ok := values["cron"]; ok {
+
+		cron = d.str(value, joinPath(path, "cron"))
+
+	}
+	if value, ok := values["duration"]; ok {
+
+		duration = d.str(value, joinPath(path, "duration"))
+
+	}
+	if value, ok := values["timezone"]; ok {
+
+		timezone = d.str(value, joinPath(path, "timezone"))
+
+	}
+
+	// anything that isn't a map, or has a bad timestamp, has already been reported
+	if node.ShortTag() != "!!map" || (values["start"] != nil && start == nil) || (values["end"] != nil && end == nil) {
+
+		return maintenanceWindow{}, false
+
+	}
+
+	// check that it makes sense
+	window, err := newMaintenanceWindow(scope, start, end, cron, duration, timezone)
+	if err != nil {
+
+		d.fail(node, path, "%v", err)
+		return maintenanceWindow{}, false
+
+	}
+
+	return window, true
+
+}
+
+// scope decodes the group, match, except and message fields shared by maintenance
+// scopes and windows
+func (d *configDecoder) scope(values map[string]*yaml.Node, path string) maintenanceScope {
+
+	// the decoded scope
+	scope := maintenanceScope{}
+
+	// decode them
+	if value, ok := values["match"]; ok {
+
+		scope.Match = d.parampackMatcher(value, joinPath(path, "match"))
+
+	}
+	if value, ok := values["except"]; ok {
+
+		scope.Except = d.parampackMatcher(value, joinPath(path, "except"))
+
+	}
+	if value, ok := values["message"]; ok {
+
+		scope.Message = d.str(value, joinPath(path, "message"))
+
+	}
+	if value, ok := values["group"]; ok {
+
+		scope.Group = d.str(value, joinPath(path, "group"))
+
+		// the groups haven't been decoded yet, so this is checked once they are
+		d.later(func() {
+
+			if _, ok := d.groups[scope.Group]; !ok && d.groups != nil && value.ShortTag() == "!!str" {
+
+				d.fail(value, joinPath(path, "group"), "unknown endpoints group %q", scope.Group)
+
+			}
+
+		})
+
+	}
+
+	return scope
+
+}
+
+// maintenanceBypass decodes the allowlist of consoles that skip maintenance
+func (d *configDecoder) maintenanceBypass(node *yaml.Node, path string) bypassOptions {
+
+	// get the fields
+	values := d.fields(node, path, "tokens", "groups", "networks", "group")
+
+	// the decoded allowlist
+	settings := bypassOptions{Tokens: []string{}, Groups: []string{}, Networks: []*net.IPNet{}}
+
+	// decode them
+	if value, ok := values["tokens"]; ok {
+
+		for i, token := range d.scalars(value, joinPath(path, "tokens")) {
+
+			// they have to be fingerprints or hashes, like the keys of the bans
+			if !d.tokenKey(value, fmt.Sprintf("%s[%d]", joinPath(path, "tokens"), i), token) {
+
+				continue
+
+			}
+
+			settings.Tokens = append(settings.Tokens, token)
+
+		}
+
+	}
+	if value, ok := values["networks"]; ok {
+
+		for i, address := range d.scalars(value, joinPath(path, "networks")) {
+
+			// parse the network
+			network, err := parseNetwork(address)
+			if err != nil {
+
+				d.fail(value, fmt.Sprintf("%s[%d]", joinPath(path, "networks"), i), "%v", err)
+				continue
+
+			}
+
+			settings.Networks = append(settings.Networks, network)
+
+		}
+
+	}
+	if value, ok := values["groups"]; ok {
+
+		settings.Groups = d.scalars(value, joinPath(path, "groups"))
+
+		// the groups haven't been decoded yet, so these are checked once they are
+		d.later(func() {
+
+			for i, group := range settings.Groups {
+
+				if _, ok := d.groups[group]; !ok && d.groups != nil {
+
+					d.fail(value, fmt.Sprintf("%s[%d]", joinPath(path, "groups"), i), "unknown endpoints group %q", group)
+
+				}
+
+			}
+
+		})
+
+	}
+	if value, ok := values["group"]; ok {
+
+		settings.Group = d.str(value, joinPath(path, "group"))
+
+		// so is this one
+		d.later(func() {
+
+			if _, ok := d.groups[settings.Group]; !ok && d.groups != nil && value.ShortTag() == "!!str" {
+
+				d.fail(value, joinPath(path, "group"), "unknown endpoints group %q", settings.Group)
+
+			}
+
+		})
+
+	}
+
+	return settings
+
+}
+
+// cache decodes the cache section, which may be missing
+func (d *configDecoder) cache(node *yaml.Node, path string) cacheOptions {
+
+	// the fields of the section
+	values := map[string]*yaml.Node{}
+
+	// get them if it's there
+	if node != nil {
+
+		values = d.fields(node, path, "maintenanceTimeout", "banlistTimeout", "ipBansTimeout", "groupdefsTimeout", "rolloutsTimeout", "directory", "waitForData", "requestTimeout", "maxBackoff", "maxAge", "stalePolicy")
+
+	}
+
+	// the directory defaults to one next to the config
+	directory := "cache"
+	if value, ok := values["directory"]; ok {
+
+		directory = d.str(value, joinPath(path, "directory"))
+
+	}
+
+	// serving doesn't wait for the data unless we're asked to
+	waitForData := false
+	if value, ok := values["waitForData"]; ok {
+
+		waitForData = d.boolean(value, joinPath(path, "waitForData"))
+
+	}
+
+	// data never goes stale unless there's a limit
+	maxAge := 0
+	if value, ok := values["maxAge"]; ok {
+
+		maxAge = d.integer(value, joinPath(path, "maxAge"))
+		if maxAge < 0 {
+
+			d.fail(value, joinPath(path, "maxAge"), "must not be negative")
+
+		}
+
+	}
+
+	// and keeps being used when it does, unless we're asked otherwise
+	stalePolicy := "open"
+	if value, ok := values["stalePolicy"]; ok {
+
+		stalePolicy = d.str(value, joinPath(path, "stalePolicy"))
+		if stalePolicy != "open" && stalePolicy != "closed" && value.ShortTag() == "!!str" {
+
+			d.fail(value, joinPath(path, "stalePolicy"), "expected open or closed, got %q", stalePolicy)
+
+		}
+
+	}
+
+	return cacheOptions{
+		MaintenanceTimeout: d.positive(values["maintenanceTimeout"], joinPath(path, "maintenanceTimeout"), 1),
+		BanlistTimeout:     d.positive(values["banlistTimeout"], joinPath(path, "banlistTimeout"), 1),
+		IPBansTimeout:      d.positive(values["ipBansTimeout"], joinPath(path, "ipBansTimeout"), 1),
+		GroupdefsTimeout:   d.positive(values["groupdefsTimeout"], joinPath(path, "groupdefsTimeout"), 1),
+		RolloutsTimeout:    d.positive(values["rolloutsTimeout"], joinPath(path, "rolloutsTimeout"), 1),
+		Directory:          directory,
+		WaitForData:        waitForData,
+		Fetch: fetchOptions{
+			RequestTimeout: d.positive(values["requestTimeout"], joinPath(path, "requestTimeout"), 10),
+			MaxBackoff:     d.positive(values["maxBackoff"], joinPath(path, "maxBackoff"), 300),
+			MaxAge:         maxAge,
+			StalePolicy:    stalePolicy,
+		},
+	}
+
+}
+
+// endpoints decodes the endpoints section
+func (d *configDecoder) endpoints(node *yaml.Node, path string, overrideDiscovery bool) map[string]endpointSet {
+
+	// the decoded groups
+	groups := map[string]endpointSet{}
+
+	// decode each group
+	d.entries(node, path, func(name string, value *yaml.Node) {
+
+		groups[name] = d.endpointSet(value, joinPath(path, name), overrideDiscovery)
+
+	})
+
+	// the default group is always needed
+	if _, ok := groups["default"]; !ok && node.ShortTag() == "!!map" {
+
+		d.fail(node, joinPath(path, "default"), "missing required group")
+
+	}
+
+	// fallbacks have to point at other groups that exist
+	for name, group := range groups {
+
+		if _, ok := groups[group.Fallback]; group.Fallback != "" && (!ok || group.Fallback == name) {
+
+			d.fail(node, joinPath(joinPath(path, name), "fallback"), "must be another endpoints group, not %q", group.Fallback)
+
+		}
+
+	}
+
+	return groups
+
+}
+
+// endpointSet decodes a single group of endpoints
+func (d *configDecoder) endpointSet(node *yaml.Node, path string, overrideDiscovery bool) endpointSet {
+
+	// the decoded group
+	set := endpointSet{}
+
+	// get the fields
+	values := d.fields(node, path, "discovery", "api", "wiiu", "3ds", "sticky", "fallback")
+
+	// the discovery host is only needed if we don't detect it
+	if overrideDiscovery {
+
+		set.Discovery = d.hostPool(d.require(values, node, path, "discovery"), joinPath(path, "discovery"))
+
+	} else if value, ok := values["discovery"]; ok {
+
+		set.Discovery = d.hostPool(value, joinPath(path, "discovery"))
+
+	}
+
+	// the rest are always needed
+	set.API = d.hostPool(d.require(values, node, path, "api"), joinPath(path, "api"))
+	set.WiiU = d.hostPool(d.require(values, node, path, "wiiu"), joinPath(path, "wiiu"))
+	set.N3DS = d.hostPool(d.require(values, node, path, "3ds"), joinPath(path, "3ds"))
+
+	// groups pick hosts at random unless they're sticky
+	if value, ok := values["sticky"]; ok {
+
+		set.Sticky = d.boolean(value, joinPath(path, "sticky"))
+
+	}
+
+	// the group used when this one has no healthy hosts
+	if value, ok := values["fallback"]; ok {
+
+		set.Fallback = d.str(value, joinPath(path, "fallback"))
+
+	}
+
+	return set
+
+}
+
+// hostPool decodes the hosts of an endpoint, which is either a single host or a
+// list of hosts, each of which is either a host or a host with a weight
+func (d *configDecoder) hostPool(node *yaml.Node, path string) hostPool {
+
+	// the decoded hosts
+	pool := hostPool{}
+
+	// a missing value has already been reported
+	if node == nil {
+
+		return pool
+
+	}
+
+	// a single host
+	if node.ShortTag() == "!!str" {
+
+		return append(pool, weightedHost{Host: node.Value, Weight: 1})
+
+	}
+
+	// a list of them
+	d.items(node, path, func(_ int, path string, item *yaml.Node) {
+
+		// a host without a weight
+		if item.ShortTag() == "!!str" {
+
+			pool = append(pool, weightedHost{Host: item.Value, Weight: 1})
+			return
+
+		}
+
+		// a host with one
+		values := d.fields(item, path, "host", "weight")
+		pool = append(pool, weightedHost{
+			Host:   d.str(d.require(values, item, path, "host"), joinPath(path, "host")),
+			Weight: d.positive(values["weight"], joinPath(path, "weight"), 1),
+		})
+
+	})
+
+	// there has to be at least one
+	if len(pool) == 0 && node.ShortTag() == "!!seq" {
+
+		d.fail(node, path, "needs at least one host")
+
+	}
+
+	return pool
+
+}
+
+// groupdefs decodes the groupdefs section
+func (d *configDecoder) groupdefs(node *yaml.Node, path string, groups map[string]endpointSet) groupdefsSource {
+
+	// the decoded groupdefs
+	source := groupdefsSource{Groupdefs: map[string]string{}}
+
+	switch {
+
+	case isSource(node):
+		source.remoteSource = d.source(node, path)
+
+	case node.ShortTag() == "!!null":
+
+	default:
+		d.entries(node, path, func(key string, value *yaml.Node) {
+
+			// the key has to be a fingerprint or a hash
+			if !d.tokenKey(value, joinPath(path, key), key) {
+
+				return
+
+			}
+
+			// decode the group name
+			group := d.str(value, joinPath(path, key))
+			if value.ShortTag() != "!!str" {
+
+				return
+
+			}
+
+			// make sure it exists
+			if _, ok := groups[group]; !ok && groups != nil {
+
+				d.fail(value, joinPath(path, key), "unknown endpoints group %q", group)
+				return
+
+			}
+
+			source.Groupdefs[key] = group
+
+		})
+
+	}
+
+	return source
+
+}
+
+// parampackMatcher decodes a map of parampack fields to the values they have to have
+func (d *configDecoder) parampackMatcher(node *yaml.Node, path string) parampackMatcher {
+
+	// the decoded matcher
+	matcher := parampackMatcher{}
+
+	// decode each field
+	d.entries(node, path, func(field string, value *yaml.Node) {
+
+		// make sure parampacks have it
+		if !isParampackField(field) {
+
+			d.fail(value, joinPath(path, field), "unknown parampack field (expected one of %s)", strings.Join(parampackFields, ", "))
+			return
+
+		}
+
+		// normalize the values the same way the parampack is
+		for _, expected := range d.scalars(value, joinPath(path, field)) {
+
+			normalized, err := parseParampackValue(field, expected)
+			if err != nil {
+
+				d.fail(value, joinPath(path, field), "%v", err)
+				continue
+
+			}
+			matcher[field] = append(matcher[field], normalized)
+
+		}
+
+	})
+
+	return matcher
+
+}
+
+// parampackRule decodes the match and except fields of a rule
+func (d *configDecoder) parampackRule(values map[string]*yaml.Node, node *yaml.Node, path string) parampackRule {
+
+	// the decoded rule
+	rule := parampackRule{Match: parampackMatcher{}}
+
+	// a rule has to say what it matches
+	if _, ok := values["match"]; !ok {
+
+		if _, ok := values["except"]; !ok && node.ShortTag() == "!!map" {
+
+			d.fail(node, path, "a rule needs either match or except")
+
+		}
+
+	}
+
+	// decode them
+	if value, ok := values["match"]; ok {
+
+		rule.Match = d.parampackMatcher(value, joinPath(path, "match"))
+
+	}
+	if value, ok := values["except"]; ok {
+
+		rule.Except = d.parampackMatcher(value, joinPath(path, "except"))
+
+	}
+
+	return rule
+
+}
+
+// denyRule decodes a single rule that refuses requests by their parampack
+func (d *configDecoder) denyRule(node *yaml.Node, path string) denyRule {
+
+	// get the fields
+	values := d.fields(node, path, "match", "except", "code", "errorCode", "message")
+
+	// the decoded rule
+	rule := denyRule{parampackRule: d.parampackRule(values, node, path), Code: 400}
+
+	// decode the rest
+	if value, ok := values["code"]; ok {
+
+		rule.Code = d.integer(value, joinPath(path, "code"))
+
+	}
+	rule.ErrorCode = d.integer(d.require(values, node, path, "errorCode"), joinPath(path, "errorCode"))
+	rule.Message = d.str(d.require(values, node, path, "message"), joinPath(path, "message"))
+
+	return rule
+
+}
+
+// route decodes a single rule that picks an endpoints group by parampack
+func (d *configDecoder) route(node *yaml.Node, path string, groups map[string]endpointSet) route {
+
+	// get the fields
+	values := d.fields(node, path, "match", "except", "group")
+
+	// the decoded route
+	decoded := route{parampackRule: d.parampackRule(values, node, path)}
+
+	// decode the group, and make sure it exists
+	if value := d.require(values, node, path, "group"); value != nil {
+
+		decoded.Group = d.str(value, joinPath(path, "group"))
+		if _, ok := groups[decoded.Group]; !ok && groups != nil && value.ShortTag() == "!!str" {
+
+			d.fail(value, joinPath(path, "group"), "unknown endpoints group %q", decoded.Group)
+
+		}
+
+	}
+
+	return decoded
+
+}
+
+// rollout decodes a single rollout
+func (d *configDecoder) rollout(node *yaml.Node, path string, groups map[string]endpointSet) rollout {
+
+	// get the fields
+	values := d.fields(node, path, "group", "percent")
+
+	// decode them
+	decoded := rollout{
+		Group:   d.str(d.require(values, node, path, "group"), joinPath(path, "group")),
+		Percent: d.number(d.require(values, node, path, "percent"), joinPath(path, "percent")),
+	}
+
+	// check that it makes sense
+	if value := values["group"]; groups != nil && value != nil && value.ShortTag() == "!!str" {
+
+		if err := decoded.validate(groups); err != nil {
+
+			d.fail(node, path, "%v", err)
+
+		}
+
+	}
+
+	return decoded
+
+}
@@ -0,0 +1,152 @@
+/*
+
+discovery/config_test.go
+
+tests for loading and validating the config
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"strings"
+	"testing"
+)
+
+// a config with everything that is required, which the tests break in different ways
+const validTestConfig = `
+options:
+  https: false
+  port: 5432
+  endpoint: "/miiverse/xml"
+  logfile: "discovery.log"
+  hashCost: 4
+  overrideDiscovery: false
+  maintenance: false
+endpoints:
+  default: {discovery: d, api: a, wiiu: w, 3ds: n}
+  other: {discovery: d, api: a, wiiu: w, 3ds: n, fallback: default}
+`
+
+func TestLoadExampleConfig(t *testing.T) {
+
+	// the example has to keep working
+	if _, err := loadConfig("config.example.yaml"); err != nil {
+
+		t.Fatal(err)
+
+	}
+
+}
+
+func TestParseConfigProblems(t *testing.T) {
+
+	for _, test := range []struct {
+		name, from, to string
+		path, problem  string
+	}{
+		{"a port that is too big", "port: 5432", "port: 70000", "options.port", "must be between 1 and 65535"},
+		{"a port that isn't a number", "port: 5432", "port: lots", "options.port", "expected integer"},
+		{"an endpoint without a slash", `endpoint: "/miiverse/xml"`, `endpoint: "xml"`, "options.endpoint", "must start with a /"},
+		{"a hash cost that is too high", "hashCost: 4", "hashCost: 100", "options.hashCost", "must be between"},
+		{"a boolean that isn't", "https: false", "https: sometimes", "options.https", "expected boolean"},
+		{"a missing option", "  logfile: \"discovery.log\"\n", "", "options.logfile", "missing required key"},
+		{"an unknown option", "hashCost: 4", "hashCost: 4\n  hashCots: 4", "options.hashCots", "unknown key"},
+		{"a short fingerprint secret", "hashCost: 4", "hashCost: 4\n  fingerprintSecret: short", "options.fingerprintSecret", "at least 16 characters"},
+		{"no default group", "  default: {", "  notdefault: {", "endpoints.default", "missing required group"},
+		{"a fallback to nowhere", "fallback: default", "fallback: nowhere", "endpoints.other.fallback", "must be another endpoints group"},
+		{"a ban that isn't keyed by a hash", "hashCost: 4", "hashCost: 4\n  bans:\n    servicetoken: {reason: no}", "options.bans.servicetoken", "expected a fingerprint or a hexadecimal-encoded hash"},
+		{"an invalid ip ban", "hashCost: 4", "hashCost: 4\n  ipBans:\n    \"203.0.113.0/33\": {reason: no}", "options.ipBans.203.0.113.0/33", "invalid"},
+		{"a rule on an unknown field", "endpoints:", "denyRules:\n  - {match: {title: 1}, errorCode: 1, message: no}\nendpoints:", "denyRules[0].match.title", "unknown parampack field"},
+		{"a rule on a title id that isn't a number", "endpoints:", "denyRules:\n  - {match: {title_id: 0005zz}, errorCode: 1, message: no}\nendpoints:", "denyRules[0].match.title_id", "isn't a number"},
+		{"a route to an unknown group", "endpoints:", "routes:\n  - {match: {platform_id: wiiu}, group: nowhere}\nendpoints:", "routes[0].group", "unknown endpoints group"},
+		{"a url without a scheme", "hashCost: 4", "hashCost: 4\n  bans: \"moderation.your-host.xyz/bans\"", "options.bans", "expected an http or https url"},
+		{"a url with a typo in the scheme", "hashCost: 4", "hashCost: 4\n  bans: \"htps://moderation.your-host.xyz/bans\"", "options.bans", "expected an http or https url"},
+		{"a url that isn't one", "hashCost: 4", "hashCost: 4\n  ipBans: {url: \"true\"}", "options.ipBans.url", "expected an http or https url"},
+		{"the proxy protocol without trusted proxies", "hashCost: 4", "hashCost: 4\n  proxyProtocol: true", "options.proxyProtocol", "needs trustedProxies"},
+		{"the proxy protocol with an empty list of trusted proxies", "hashCost: 4", "hashCost: 4\n  trustedProxies: []\n  proxyProtocol: true", "options.proxyProtocol", "needs trustedProxies"},
+		{"a rollout of more than everyone", "endpoints:", "rollouts:\n  - {group: other, percent: 101}\nendpoints:", "rollouts[0]", "percent must be between 0 and 100"},
+	} {
+
+		// break the config
+		if !strings.Contains(validTestConfig, test.from) {
+
+			t.Fatalf("%s: the config doesn't contain %q", test.name, test.from)
+
+		}
+		_, err := parseConfig([]byte(strings.Replace(validTestConfig, test.from, test.to, 1)))
+
+		// it has to be refused with a problem at the right place
+		problems, ok := err.(configErrors)
+		if !ok {
+
+			t.Errorf("%s: expected problems with the config, got %v", test.name, err)
+			continue
+
+		}
+		found := false
+		for _, problem := range problems {
+
+			if strings.HasPrefix(problem.Path, test.path) && strings.Contains(problem.Message, test.problem) && problem.Line > 0 {
+
+				found = true
+
+			}
+
+		}
+		if found == false {
+
+			t.Errorf("%s: expected %q at %s, got:\n%v", test.name, test.problem, test.path, err)
+
+		}
+
+	}
+
+}
+
+func TestParseConfigReportsEveryProblem(t *testing.T) {
+
+	// every problem is reported at once, in order
+	config := strings.Replace(strings.Replace(validTestConfig, "port: 5432", "port: 0", 1), "hashCost: 4", "hashCost: 100", 1)
+	_, err := parseConfig([]byte(config))
+	problems, ok := err.(configErrors)
+	if !ok || len(problems) != 2 {
+
+		t.Fatalf("expected 2 problems, got %v", err)
+
+	}
+	if problems[0].Path != "options.port" || problems[0].Line != 4 || problems[1].Path != "options.hashCost" || problems[1].Line != 7 {
+
+		t.Fatalf("expected options.port on line 4 and options.hashCost on line 7, got:\n%v", err)
+
+	}
+
+}
+
+func TestParseConfig(t *testing.T) {
+
+	// a valid config decodes into what it says
+	config, err := parseConfig([]byte(validTestConfig))
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+	if config.Options.Port != 5432 || config.Options.Endpoint != "/miiverse/xml" || config.Endpoints["other"].Fallback != "default" {
+
+		t.Fatalf("decoded the config wrong: %+v", config)
+
+	}
+
+	// and an empty one is refused
+	if _, err = parseConfig([]byte("")); err == nil {
+
+		t.Fatal("expected an empty config to be refused")
+
+	}
+
+}
@@ -11,51 +11,70 @@ package main
 
 import (
 	// internals
-	"encoding/json"
 	"encoding/xml"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"reflect"
+	"strings"
 	"time"
 	// externals
 	"github.com/gorilla/mux"
-	"github.com/superwhiskers/yaml"
-	"github.com/tomasen/realip"
 	"gitlab.com/superwhiskers/libninty"
-	//"gopkg.in/yaml.v3" when yaml.v3 is available, i will use that instead
 )
 
 // a set of variables
 var (
-	maintenanceURL    string
-	groupdefsURL      string
-	banURL            string
-	updateJSON        string
-	err               error
-	banData           map[string]interface{}
-	defaultEndpoints  map[string]interface{}
-	maintenanceData   bool
-	marshalledXML     []byte
-	overrideDiscovery bool
-	bcryptCost        int
-	endpoints         map[string]interface{}
-	groupdefsData     map[string]interface{}
+	maintenanceURL        string
+	groupdefsURL          string
+	banURL                string
+	ipBanURL              string
+	updateJSON            string
+	err                   error
+	overrideDiscovery     bool
+	bcryptCost            int
+	fingerprintSecret     string
+	matchRawServicetokens bool
+	rolloutURL            string
+	trustedProxies        []*net.IPNet
 )
 
 // the handler for the discovery endpoint
 func discoveryHandler(w http.ResponseWriter, r *http.Request) {
 
+	// everything this request is answered from. it's loaded once, so updates that
+	// happen while it's being answered don't change it halfway through
+	state := loadState()
+
 	// the response
 	var fabricatedXML *result
 
 	// trigger to tell if we will actually be able to ban it
 	attemptToBan := true
 
-	// get the servicetoken
-	servicetoken, err := libninty.DecodeServiceToken(r.Header.Get("X-Nintendo-Servicetoken"))
+	// the fingerprint of the servicetoken, if we are able to make one
+	tokenFingerprint := ""
+
+	// how the servicetoken is shown in the log
+	tokenKind := "hashed"
+
+	// the servicetoken header exactly as the console sent it
+	rawToken := r.Header.Get("X-Nintendo-Servicetoken")
+
+	// the servicetokens compared against legacy bcrypt entries
+	candidates := []string{}
+
+	// normalize the servicetoken. the normalized form is what gets logged,
+	// fingerprinted and compared against the bans and the groupdefs
+	token, err := normalizeServiceToken(rawToken)
+
+	// what is shown in the log
+	servicetoken := token
+
+	// check for errors
 	if err != nil {
 
 		// display a message
@@ -64,10 +83,23 @@ func discoveryHandler(w http.ResponseWriter, r *http.Request) {
 		// set the attempt to ban flag
 		attemptToBan = false
 
+	} else if fingerprintSecret != "" {
+
+		// fingerprint the servicetoken. unlike the hash, this is the same for every
+		// request made with it, so it can be searched for in the log and pasted
+		// straight into the bans or the groupdefs
+		tokenFingerprint = fingerprint(token, fingerprintSecret)
+		servicetoken = tokenFingerprint
+		tokenKind = "fingerprint"
+		candidates = append(candidates, token)
+
 	} else {
 
+		// compare the normalized servicetoken against legacy entries
+		candidates = append(candidates, token)
+
 		// hash the servicetoken
-		servicetoken, err = hash(servicetoken, bcryptCost)
+		servicetoken, err = hash(token, bcryptCost)
 		if err != nil {
 
 			// display a message
@@ -80,34 +112,48 @@ func discoveryHandler(w http.ResponseWriter, r *http.Request) {
 
 	}
 
+	// entries made before servicetokens were normalized were hashed from the raw header
+	if matchRawServicetokens == true && rawToken != "" {
+
+		candidates = append(candidates, rawToken)
+
+	}
+
 	// get the unpacked parampack
 	parampack, err := libninty.DecodeParampack(r.Header.Get("X-Nintendo-Parampack"))
 	if err != nil {
 		log.Printf("-> unable to decode parampack. shown data is a nullified parampack\n")
 	}
 
+	// and normalize its fields so the rules can match them
+	fields := parampackFieldsFrom(parampack)
+
+	// get the address they're connecting from
+	clientIP := clientIP(r, trustedProxies)
+
 	// print out request data
 	log.Printf("-> ~ new request ~\n")
-	log.Printf("-> service token (hashed): %s\n", servicetoken)
-	log.Printf("-> ip address: %s\n", realip.FromRequest(r))
+	log.Printf("-> service token (%s): %s\n", tokenKind, servicetoken)
+	log.Printf("-> ip address: %s\n", clientIP)
 	log.Printf("-> parampack: %+v\n", parampack)
 
-	// first, check if we are in maintenance mode
-	if maintenanceData == true {
+	// first, check if they're connecting from a banned network
+	if ipBanEntry, banned := matchIPBans(state.ipBans, clientIP); banned == true {
 
-		// then we are
+		// let the user know which one it was
+		log.Printf("-> refused by the ip ban on %s\n", ipBanEntry.Network)
 
 		// fabricate the response
 		fabricatedXML = &result{
 			HasError:  1,
 			Version:   1,
-			Code:      400,
-			ErrorCode: 3,
-			Message:   "SERVICE_MAINTENANCE",
+			Code:      ipBanEntry.Code,
+			ErrorCode: ipBanEntry.ErrorCode,
+			Message:   ipBanEntry.Reason,
 		}
 
 		// marshal it
-		marshalledXML, err = xml.MarshalIndent(fabricatedXML, "  ", "    ")
+		marshalledXML, err := xml.MarshalIndent(fabricatedXML, "  ", "    ")
 		if err != nil {
 
 			// output an error message if an error occured
@@ -125,159 +171,214 @@ func discoveryHandler(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	// otherwise, we check if the person connecting is banned
-	if attemptToBan == true {
+	// the group they get if nothing else matches
+	group := "default"
 
-		// loop over the bans
-		for hash, banMap := range banData {
+	// consoles are told apart by their fingerprint if they have one, which
+	// keeps them in the same rollouts and on the same hosts of sticky groups
+	identity := tokenFingerprint
+	if identity == "" && attemptToBan == true {
 
-			// check if they're banned
-			banned, err := compareHash(r.Header.Get("X-Nintendo-Servicetoken"), hash)
+		identity = token
 
-			// check for errors decoding
-			if err != nil {
+	}
 
-				// show the error
-				log.Printf("[err]: %s is not a hexadecimal-encoded hash...\n", hash)
+	// the first route that matches their parampack picks the group. if none
+	// do, we look the servicetoken up in the groupdefs, and then the rollouts
+	if routed, match := matchRoutes(state.routes, fields); match == true {
 
-			}
+		group = routed
 
-			// check if they're banned
-			if banned == true {
+	} else if hash, match := state.groupdefsIndex.lookup(tokenFingerprint, candidates); match == true {
 
-				// they're banned, so we can respond with a ban message
-				fabricatedXML = &result{
-					HasError:  1,
-					Version:   1,
-					Code:      400,
-					ErrorCode: 7,
-					Message:   banMap.(map[interface{}]interface{})["reason"].(string),
-				}
+		group = state.groupdefs[hash]
 
-				// break from the loop
-				break
+	} else if rolled, match := matchRollouts(state.rollouts, identity); match == true {
 
-			}
+		// they fell into one of the rollouts
+		group = rolled
+
+	}
+
+	// consoles on the maintenance bypass allowlist skip maintenance. this is why
+	// the group is picked first, since the allowlist can have groups on it. looking
+	// them up can mean comparing bcrypt hashes, so it's only done once maintenance
+	// applies to them, and only once
+	var bypassReason string
+	var bypassing, bypassChecked bool
+	bypasses := func() bool {
+
+		if bypassChecked == false {
+
+			bypassReason, bypassing = state.bypass.allows(tokenFingerprint, candidates, clientIP, group)
+			bypassChecked = true
 
 		}
 
+		return bypassing
+
 	}
 
-	// check if we've already created a response to send
-	if fabricatedXML == nil {
+	// then, check if everyone is in maintenance
+	globalMessage, globalMaintenance := state.maintenance.global(time.Now())
 
-		// check if we override discovery
-		if overrideDiscovery == true {
+	// data that has gone stale and fails closed puts everyone in maintenance too
+	if staleName, stale := staleSource(time.Now()); stale == true && globalMaintenance == false {
 
-			// the match variable that we use to check if we ever found a match
-			match := false
+		log.Printf("-> %s is stale and fails closed\n", staleName)
+		globalMessage, globalMaintenance = defaultMaintenanceMessage, true
 
-			// loop over the groupdefs
-			for hash, group := range groupdefsData {
+	}
+	if globalMaintenance == true && bypasses() == false {
 
-				// check if the servicetokens match
-				match, err = compareHash(r.Header.Get("X-Nintendo-Servicetoken"), hash)
+		// then we are
 
-				// check for errors decoding
-				if err != nil {
+		// fabricate the response
+		fabricatedXML = &result{
+			HasError:  1,
+			Version:   1,
+			Code:      400,
+			ErrorCode: 3,
+			Message:   globalMessage,
+		}
 
-					// show the error
-					log.Printf("[err]: %s is not a hexadecimal-encoded hash...\n", hash)
+		// marshal it
+		marshalledXML, err := xml.MarshalIndent(fabricatedXML, "  ", "    ")
+		if err != nil {
+
+			// output an error message if an error occured
+			log.Printf("[err]: could not marshal xml...\n")
+			log.Printf("       error: %v\n", err)
+
+		}
 
-				}
+		// send the xml
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(marshalledXML)
 
-				// check if they're banned
-				if match == true {
+		// don't continue
+		return
 
-					// we do
-					endpointset := endpoints[group.(string)].(map[string]interface{})
+	}
 
-					// and fabricate the response
-					fabricatedXML = &result{
-						HasError:   0,
-						Version:    1,
-						Host:       endpointset["discovery"].(string),
-						APIHost:    endpointset["api"].(string),
-						PortalHost: endpointset["wiiu"].(string),
-						N3DSHost:   endpointset["3ds"].(string),
-					}
+	// otherwise, we check if any of the rules refuse their parampack
+	for i, rule := range state.denyRules {
 
-					// break from the loop
-					break
+		if rule.matches(fields) {
 
-				}
+			// let the user know which one it was
+			log.Printf("-> refused by denyRules[%d]\n", i)
 
+			// they're refused, so we can respond with the rule's message
+			fabricatedXML = &result{
+				HasError:  1,
+				Version:   1,
+				Code:      rule.Code,
+				ErrorCode: rule.ErrorCode,
+				Message:   rule.Message,
 			}
 
-			// if match was never set to true, we need to give them the standard endpoints
-			if match == false {
+			// the first matching rule wins
+			break
+
+		}
+
+	}
+
+	// then, we check if the person connecting is banned
+	if attemptToBan == true && fabricatedXML == nil {
+
+		// look the servicetoken up in the bans that haven't run out, so an old ban
+		// can't hide one that still applies
+		now := time.Now()
+		if hash, banned := state.banIndex.lookupWhere(tokenFingerprint, candidates, func(key string) bool {
 
-				// otherwise, fabricate the response as normal
-				fabricatedXML = &result{
-					HasError:   0,
-					Version:    1,
-					Host:       defaultEndpoints["discovery"].(string),
-					APIHost:    defaultEndpoints["api"].(string),
-					PortalHost: defaultEndpoints["wiiu"].(string),
-					N3DSHost:   defaultEndpoints["3ds"].(string),
-				}
+			return state.bans[key].expired(now) == false
 
+		}); banned == true {
+
+			// they're banned, so we can respond with a ban message
+			fabricatedXML = &result{
+				HasError:  1,
+				Version:   1,
+				Code:      400,
+				ErrorCode: 7,
+				Message:   state.bans[hash].message(),
 			}
 
-		} else {
+		}
 
-			// the match variable that we use to check if we ever found a match
-			match := false
+	}
 
-			// loop over the groupdefs
-			for hash, group := range groupdefsData {
+	// check if we've already created a response to send
+	if fabricatedXML == nil {
 
-				// check if the servicetokens match
-				match, err = compareHash(r.Header.Get("X-Nintendo-Servicetoken"), hash)
+		// check if they would be in maintenance if they weren't on the allowlist
+		wouldBeInMaintenance := globalMaintenance
+		if wouldBeInMaintenance == false {
 
-				// check for errors decoding
-				if err != nil {
+			_, wouldBeInMaintenance = state.maintenance.scoped(group, fields, time.Now())
 
-					// show the error
-					log.Printf("[err]: %s is not a hexadecimal-encoded hash...\n", hash)
+		}
+		if wouldBeInMaintenance == true && bypasses() == true {
 
-				}
+			// let the user know why they skipped it
+			log.Printf("-> skipping maintenance (%s)\n", bypassReason)
 
-				// check if they're banned
-				if match == true {
+			// they go to the staging group, if there is one
+			if staging, ok := state.bypass.staging(); ok == true {
 
-					// we do
-					endpointset := endpoints[group.(string)].(map[string]interface{})
+				group = staging
 
-					// and fabricate the response
-					fabricatedXML = &result{
-						HasError:   0,
-						Version:    1,
-						Host:       r.Host,
-						APIHost:    endpointset["api"].(string),
-						PortalHost: endpointset["wiiu"].(string),
-						N3DSHost:   endpointset["3ds"].(string),
-					}
+			}
 
-					// break from the loop
-					break
+		}
 
-				}
+		// they get the endpoints of that group (or its fallbacks, if it's down), picking one host for each
+		group, endpointset, up := resolveEndpoints(state.endpoints, group, identity, state.health, overrideDiscovery)
+		if up == false {
+
+			// every group they could use is down, so we tell them to try again later
+			log.Printf("-> no healthy endpoints group is left\n")
+			fabricatedXML = &result{
+				HasError:  1,
+				Version:   1,
+				Code:      400,
+				ErrorCode: 3,
+				Message:   "SERVICE_MAINTENANCE",
+			}
 
+		} else if message, inMaintenance := state.maintenance.scoped(group, fields, time.Now()); inMaintenance == true && bypasses() == false {
+
+			// only some consoles are in maintenance, and they're one of them
+			log.Printf("-> in scoped maintenance (endpoints group %s)\n", group)
+			fabricatedXML = &result{
+				HasError:  1,
+				Version:   1,
+				Code:      400,
+				ErrorCode: 3,
+				Message:   message,
+			}
+
+		} else {
+
+			// let the user know which group they got
+			log.Printf("-> using endpoints group %s\n", group)
+
+			// fabricate the response
+			fabricatedXML = &result{
+				HasError:   0,
+				Version:    1,
+				Host:       endpointset.Discovery,
+				APIHost:    endpointset.API,
+				PortalHost: endpointset.WiiU,
+				N3DSHost:   endpointset.N3DS,
 			}
 
-			// if match was never set to true, we need to give them the standard endpoints
-			if match == false {
+			// if we don't override discovery, we point them back at the host they used
+			if overrideDiscovery == false {
 
-				// otherwise, fabricate the response as normal
-				fabricatedXML = &result{
-					HasError:   0,
-					Version:    1,
-					Host:       r.Host,
-					APIHost:    defaultEndpoints["api"].(string),
-					PortalHost: defaultEndpoints["wiiu"].(string),
-					N3DSHost:   defaultEndpoints["3ds"].(string),
-				}
+				fabricatedXML.Host = r.Host
 
 			}
 
@@ -286,7 +387,7 @@ func discoveryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// marshal it
-	marshalledXML, err = xml.MarshalIndent(fabricatedXML, "  ", "    ")
+	marshalledXML, err := xml.MarshalIndent(fabricatedXML, "  ", "    ")
 	if err != nil {
 
 		// output an error message if an error occured
@@ -304,62 +405,71 @@ func discoveryHandler(w http.ResponseWriter, r *http.Request) {
 // the main function, obviously
 func main() {
 
-	// set the default map type
-	*yaml.DefaultMapType = reflect.TypeOf(map[string]interface{}{})
+	// check if we were asked to run a command instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "hash-token" {
 
-	// variable that the config is parsed into
-	config := make(map[string]interface{})
+		os.Exit(hashTokenCommand(os.Args[2:]))
 
-	// get the file data
-	confByte, err := readFileByte("config.yaml")
+	}
 
-	// check for errors
-	if err != nil {
+	// the flags of the server
+	var (
+		flags      = flag.NewFlagSet("discovery", flag.ContinueOnError)
+		configFile = flags.String("config", "config.yaml", "config file to load")
+		tlsCert    = flags.String("tls-cert", "tls/cert.pem", "certificate to serve https with")
+		tlsKey     = flags.String("tls-key", "tls/key.pem", "private key of the certificate to serve https with")
+		listen     = flags.String("listen", "", "address to listen on, like 127.0.0.1:5432 (defaults to every address on options.port)")
+	)
 
-		// show a message
-		fmt.Printf("[err]: error while loading config.yaml.\n")
-		fmt.Printf("       you should copy config.example.yaml to config.yaml and edit it.\n")
+	// explain how to use it
+	flags.Usage = func() {
 
-		// exit
-		os.Exit(1)
+		fmt.Fprintf(flags.Output(), "usage: discovery [flags]\n")
+		fmt.Fprintf(flags.Output(), "       discovery hash-token [flags] [servicetoken...]\n\n")
+		fmt.Fprintf(flags.Output(), "any option in the config can be overridden with an environment variable named\n")
+		fmt.Fprintf(flags.Output(), "after it, like DISCOVERY_PORT for options.port or DISCOVERY_CACHE_MAX_AGE for\n")
+		fmt.Fprintf(flags.Output(), "options.cache.maxAge, and ${NAME} (or ${NAME:-default}) anywhere in the config is\n")
+		fmt.Fprintf(flags.Output(), "replaced with the environment variable NAME.\n\n")
+		flags.PrintDefaults()
+
+	}
+
+	// parse them
+	if err := flags.Parse(os.Args[1:]); err != nil {
+
+		os.Exit(2)
 
 	}
 
-	// parse it to yaml
-	err = yaml.Unmarshal(confByte, config)
+	// load the config
+	config, err := loadConfig(*configFile)
 
 	// check for errors
 	if err != nil {
 
-		// show a message
-		fmt.Printf("[err]: there is an error in your yaml in config.yaml...\n")
+		// show what went wrong
+		reportConfigError(os.Stdout, *configFile, err)
 
-		// and show a traceback
-		panic(err)
+		// exit
+		os.Exit(1)
 
 	}
 
-	// predefine some variables
+	// set some variables
 	var (
-		pullMaintenanceFromURL bool
-		pullBansFromURL        bool
-		pullGroupdefsFromURL   bool
-	)
-
-	// set some others
-	var (
-		settings      = config["options"].(map[string]interface{})
-		logfile       = settings["logfile"].(string)
-		serverPort    = settings["port"].(int)
-		cacheSettings = settings["cache"].(map[string]interface{})
+		settings      = config.Options
+		logfile       = settings.Logfile
+		serverPort    = settings.Port
+		cacheSettings = settings.Cache
 	)
 
 	// these have to be left out because we're modifying existing ones
-	endpoints = config["endpoints"].(map[string]interface{})
-	bcryptCost = settings["hashCost"].(int)
-	overrideDiscovery = settings["overrideDiscovery"].(bool)
-	endpointForDiscovery := settings["endpoint"].(string)
-	defaultEndpoints = endpoints["default"].(map[string]interface{})
+	bcryptCost = settings.HashCost
+	fingerprintSecret = settings.FingerprintSecret
+	matchRawServicetokens = settings.MatchRawServicetokens
+	overrideDiscovery = settings.OverrideDiscovery
+	endpointForDiscovery := settings.Endpoint
+	trustedProxies = settings.TrustedProxies
 
 	// open the logfile
 	file, err := os.OpenFile(logfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
@@ -381,34 +491,24 @@ func main() {
 	// set the output for the logger
 	log.SetOutput(io.MultiWriter(os.Stdout, file))
 
-	// groupdefs is either a url to get a plaintext
+	// let the user know that the logged servicetokens can't be matched up without a secret
+	if fingerprintSecret == "" {
+
+		log.Printf("-> options.fingerprintSecret is not set, so logged servicetokens are salted hashes\n")
+		log.Printf("   that differ on every request. set it to log stable fingerprints instead\n")
+
+	}
+
+	// the state requests are answered from
+	state := newState(config)
+
+	// groupdefs are either a url to get a plaintext
 	// response from (like this:
 	//
 	// { "servicetoken-one": "group-name", "servicetoken-two": "group-name" }
 	//
-	// )
-	switch config["groupdefs"].(type) {
-
-	case string:
-		pullGroupdefsFromURL = true
-		groupdefsURL = config["groupdefs"].(string)
-		groupdefsData = map[string]interface{}{}
-
-	case map[string]interface{}:
-		pullGroupdefsFromURL = false
-		groupdefsData = config["groupdefs"].(map[string]interface{})
-
-	case nil:
-		pullGroupdefsFromURL = false
-		groupdefsData = map[string]interface{}{}
-
-	default:
-		log.Printf("[err]: the groupdefs field in the config must be either a map[string]interface{} or\n")
-		log.Printf("       a string of a url to a website where the server can fetch the status...\n")
-		log.Printf("current type: %v\n", reflect.TypeOf(config["groupdefs"]))
-		os.Exit(1)
-
-	}
+	// ) or a map of servicetokens to group names
+	groupdefsURL = config.Groupdefs.URL
 
 	// maintenance is either a url to get a plaintext
 	// response from (like this:
@@ -416,235 +516,187 @@ func main() {
 	// { "inMaintenance": false }
 	//
 	// ) or a boolean
-	switch settings["maintenance"].(type) {
-
-	case string:
-		pullMaintenanceFromURL = true
-		maintenanceURL = settings["maintenance"].(string)
-		maintenanceData = false
-
-	case bool:
-		pullMaintenanceFromURL = false
-		maintenanceData = settings["maintenance"].(bool)
-
-	default:
-		log.Printf("[err]: the maintenance field in the options must either be a boolean\n")
-		log.Printf("       or a string of a url to a website where the server can fetch the status...\n")
-		log.Printf("current type: %v\n", reflect.TypeOf(settings["maintenance"]))
-		os.Exit(1)
+	maintenanceURL = settings.Maintenance.URL
 
-	}
-
-	// banList is either a url to get a plaintext
+	// bans are either a url to get a plaintext
 	// response from (like this:
 	//
 	// { "one-servicetoken": { "reason": "haha-yes" }, "two-servicetoken": { "reason": "haha-yes" } }
 	//
-	// ) or a list of banned servicetokens
-	switch settings["bans"].(type) {
-
-	case string:
-		pullBansFromURL = true
-		banURL = settings["bans"].(string)
-		banData = map[string]interface{}{}
-
-	case map[string]interface{}:
-		pullBansFromURL = false
-		banData = settings["bans"].(map[string]interface{})
-
-	case nil:
-		pullBansFromURL = false
-		banData = map[string]interface{}{}
-
-	default:
-		log.Printf("[err]: the bans field in the options must either be a map of strings\n")
-		log.Printf("       containing banned servicetokens or a url that points to an endpoint\n")
-		log.Printf("       that will return a map of banned servicetokens...\n")
-		log.Printf("current type: %v\n", reflect.TypeOf(settings["bans"]))
-		os.Exit(1)
-
-	}
+	// ) or a map of banned servicetokens
+	banURL = settings.Bans.URL
 
-	// check if we use a goroutine to update the maintenance status
-	if pullMaintenanceFromURL == true {
-
-		// start it
-		go func() {
-
-			// do this forever
-			for {
-
-				// temporary variables for unpacking the data
-				var tmp interface{}
+	// ip bans are either a url to get a plaintext
+	// response from (like this:
+	//
+	// { "203.0.113.0/24": { "reason": "haha-yes", "errorCode": 7 } }
+	//
+	// ) or a map of banned networks
+	ipBanURL = settings.IPBans.URL
 
-				// update the maintenance status
-				updateData, err := get(maintenanceURL)
-				if err != nil {
+	// rollouts are either a url to get a plaintext
+	// response from (like this:
+	//
+	// [ { "group": "group-name", "percent": 5 } ]
+	//
+	// ) or a list of rollouts
+	rolloutURL = config.Rollouts.URL
 
-					// same here
-					log.Printf("[err]: your maintenance update url might be invalid\n")
+	// check if we keep track of which hosts are up
+	if settings.HealthCheck != nil {
 
-				} else {
+		state.health = newHealthChecker(*settings.HealthCheck, state.endpoints)
+		state.health.start()
 
-					// unmarshal json data gotten from the url
-					err = json.Unmarshal([]byte(updateData), &tmp)
+	}
 
-					// handle errors
-					if err != nil {
+	// requests (and updates) can use it now
+	startConfig = config
+	storeState(state)
 
-						// show an error message if needed
-						log.Printf("[err]: the data at your maintenance update url is invalid json...\n")
+	// make the directory the data pulled from urls is cached in
+	if cacheSettings.Directory != "" && (maintenanceURL != "" || banURL != "" || ipBanURL != "" || groupdefsURL != "" || rolloutURL != "") {
 
-					} else {
+		if err := makeDirectory(cacheSettings.Directory); err != nil {
 
-						// move this data into the variable
-						maintenanceData = tmp.(map[string]interface{})["inMaintenance"].(bool)
+			// caching just won't work, which isn't worth stopping over
+			log.Printf("[err]: unable to create the cache directory %s...\n", cacheSettings.Directory)
+			log.Printf("       error: %v\n", err)
 
-						// let the user know that we did it
-						log.Printf("-> updated maintenance status\n")
+		}
 
-					}
+	}
 
-				}
+	// check if we use a goroutine to update the maintenance status
+	if maintenanceURL != "" {
 
-				// timeout
-				time.Sleep(time.Duration(cacheSettings["maintenanceTimeout"].(int)) * time.Second)
+		pollSource("maintenance status", settings.Maintenance.remoteSource, sourceCacheFile(cacheSettings.Directory, "maintenance status"), cacheSettings.MaintenanceTimeout, cacheSettings.Fetch, applyMaintenance)
 
-			}
+	} else if settings.Maintenance.File != "" {
 
-		}()
+		watchSource("maintenance status", settings.Maintenance.File, applyMaintenance)
 
 	}
 
 	// check if we use a goroutine to update banlists
-	if pullBansFromURL == true {
+	if banURL != "" {
 
-		// start it
-		go func() {
+		pollSource("banlist", settings.Bans.remoteSource, sourceCacheFile(cacheSettings.Directory, "banlist"), cacheSettings.BanlistTimeout, cacheSettings.Fetch, applyBans)
 
-			// do this forever
-			for {
+	} else if settings.Bans.File != "" {
 
-				// temporary variables for unpacking the data
-				var tmp interface{}
+		watchSource("banlist", settings.Bans.File, applyBans)
 
-				// update the bans
-				updateData, err := get(banURL)
-				if err != nil {
+	}
 
-					// just show a message and go on
-					log.Printf("[err]: your banlist update url might be invalid, please check this...\n")
+	// check if we use a goroutine to update ip bans
+	if ipBanURL != "" {
 
-				} else {
+		pollSource("ip bans", settings.IPBans.remoteSource, sourceCacheFile(cacheSettings.Directory, "ip bans"), cacheSettings.IPBansTimeout, cacheSettings.Fetch, applyIPBans)
 
-					// unmarshal json data gotten from the url
-					err = json.Unmarshal([]byte(updateData), &tmp)
+	} else if settings.IPBans.File != "" {
 
-					// handle errors
-					if err != nil {
+		watchSource("ip bans", settings.IPBans.File, applyIPBans)
 
-						// show an error message if needed
-						log.Printf("[err]: the data at your maintenance update url is invalid json...\n")
+	}
+
+	// check if we use a goroutine to update groupdefs
+	if groupdefsURL != "" {
 
-					} else {
+		pollSource("groupdefs", config.Groupdefs.remoteSource, sourceCacheFile(cacheSettings.Directory, "groupdefs"), cacheSettings.GroupdefsTimeout, cacheSettings.Fetch, applyGroupdefs)
 
-						// move this data into the ban data variable
-						banData = tmp.(map[string]interface{})
+	} else if config.Groupdefs.File != "" {
 
-						// let the user know
-						log.Printf("-> updated banlists...\n")
+		watchSource("groupdefs", config.Groupdefs.File, applyGroupdefs)
 
-					}
+	}
 
-				}
+	// check if we use a goroutine to update rollouts
+	if rolloutURL != "" {
 
-				// timeout
-				time.Sleep(time.Duration(cacheSettings["banlistTimeout"].(int)) * time.Second)
+		pollSource("rollouts", config.Rollouts.remoteSource, sourceCacheFile(cacheSettings.Directory, "rollouts"), cacheSettings.RolloutsTimeout, cacheSettings.Fetch, applyRollouts)
 
-			}
+	} else if config.Rollouts.File != "" {
 
-		}()
+		watchSource("rollouts", config.Rollouts.File, applyRollouts)
 
 	}
 
-	// check if we use a goroutine to update groupdefs
-	if pullGroupdefsFromURL == true {
-
-		// start it
-		go func() {
+	// create a new router
+	r := mux.NewRouter()
 
-			// do this forever
-			for {
+	// register the handler for the discovery endpoint
+	r.HandleFunc(endpointForDiscovery, discoveryHandler)
 
-				// temporary variables for unpacking the data
-				var tmp interface{}
+	// register the handler for the status endpoint, if there is one
+	if settings.Status.Endpoint != "" {
 
-				// update the bans
-				updateData, err := get(groupdefsURL)
-				if err != nil {
+		statusToken = settings.Status.Token
+		r.HandleFunc(settings.Status.Endpoint, statusHandler)
 
-					// just show a message and go on
-					log.Printf("[err]: your groupdefs update url might be invalid, please check this...\n")
+	}
 
-				} else {
+	// register the handler for the webhook, if there is one
+	if settings.Webhook.Endpoint != "" {
 
-					// unmarshal json data gotten from the url
-					err = json.Unmarshal([]byte(updateData), &tmp)
+		webhookSecret = settings.Webhook.Secret
+		webhookMaxSkew = settings.Webhook.MaxSkew
+		r.HandleFunc(strings.TrimSuffix(settings.Webhook.Endpoint, "/")+"/{source}", webhookHandler).Methods("POST")
 
-					// handle errors
-					if err != nil {
+	}
 
-						// show an error message if needed
-						log.Printf("[err]: the data at your groupdefs update url is invalid json...\n")
+	// reload the config on SIGHUP, and when it changes if we were asked to
+	handleReloads(*configFile, settings.ReloadOnChange)
 
-					} else {
+	// server configuration
+	srv := &http.Server{
+		Handler:      r,
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
 
-						// move this data into the ban data variable
-						groupdefsData = tmp.(map[string]interface{})
+	// wait until everything pulled from a url has data, if we were asked to
+	if cacheSettings.WaitForData == true {
 
-						// let the user know
-						log.Printf("-> updated groupdefs...\n")
+		log.Printf("-> waiting for the data pulled from urls...\n")
+		sourcesReady.Wait()
 
-					}
+	}
 
-				}
+	// listen on the port, or the address we were given
+	address := fmt.Sprintf(":%d", serverPort)
+	if *listen != "" {
 
-				// timeout
-				time.Sleep(time.Duration(cacheSettings["groupdefsTimeout"].(int)) * time.Second)
+		address = *listen
 
-			}
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
 
-		}()
+		log.Fatal(err)
 
 	}
 
-	// create a new router
-	r := mux.NewRouter()
+	// read proxy protocol headers from trusted proxies if we were asked to
+	if settings.ProxyProtocol == true {
 
-	// register the handler for the discovery endpoint
-	r.HandleFunc(endpointForDiscovery, discoveryHandler)
+		listener = &proxyListener{Listener: listener, trusted: trustedProxies}
 
-	// server configuration
-	srv := &http.Server{
-		Handler:      r,
-		Addr:         fmt.Sprintf(":%d", serverPort),
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
 	}
 
 	// start the server
-	log.Printf("-> starting server...\n")
+	log.Printf("-> starting server on %s...\n", listener.Addr())
 
 	// do we use https?
-	if settings["https"].(bool) == true {
+	if settings.HTTPS == true {
 
 		// host on https
-		log.Fatal(srv.ListenAndServeTLS("tls/cert.pem", "tls/key.pem"))
+		log.Fatal(srv.ServeTLS(listener, *tlsCert, *tlsKey))
 
 	} else {
 
 		// host on http
-		log.Fatal(srv.ListenAndServe())
+		log.Fatal(srv.Serve(listener))
 
 	}
 
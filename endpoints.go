@@ -0,0 +1,174 @@
+/*
+
+discovery/endpoints.go
+
+picking which host of an endpoints group a console is sent to
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"crypto/sha256"
+	"encoding/binary"
+	"log"
+	"math/rand"
+)
+
+// weightedHost is one of the hosts that can serve an endpoint. hosts with a higher
+// weight get a bigger share of the consoles
+type weightedHost struct {
+	Host   string
+	Weight int
+}
+
+// hostPool is every host that can serve an endpoint
+type hostPool []weightedHost
+
+// healthy returns the hosts of the pool that are up
+func (p hostPool) healthy(checker *healthChecker) hostPool {
+
+	// the hosts that are up
+	up := hostPool{}
+
+	// check each of them
+	for _, host := range p {
+
+		if checker.healthy(host.Host) {
+
+			up = append(up, host)
+
+		}
+
+	}
+
+	return up
+
+}
+
+// pick chooses one of the hosts in proportion to their weights. if identity isn't empty,
+// the same identity always gets the same host for as long as the pool doesn't change
+func (p hostPool) pick(role, identity string) string {
+
+	// add up the weights
+	total := 0
+	for _, host := range p {
+
+		total += host.Weight
+
+	}
+
+	// there's nothing to pick from
+	if total == 0 {
+
+		return ""
+
+	}
+
+	// pick a point along the weights, either from the identity or at random
+	var point int
+	if identity != "" {
+
+		sum := sha256.Sum256([]byte(role + "\x00" + identity))
+		point = int(binary.BigEndian.Uint64(sum[:8]) % uint64(total))
+
+	} else {
+
+		point = rand.Intn(total)
+
+	}
+
+	// find the host it landed on
+	for _, host := range p {
+
+		if point < host.Weight {
+
+			return host.Host
+
+		}
+		point -= host.Weight
+
+	}
+
+	return p[len(p)-1].Host
+
+}
+
+// chosenEndpoints are the hosts an endpoints group gives a console
+type chosenEndpoints struct {
+	Discovery string
+	API       string
+	WiiU      string
+	N3DS      string
+}
+
+// pick chooses a healthy host for each of the endpoints of the group. sticky groups
+// always give the same console the same hosts. it fails if one of the endpoints
+// that consoles need has no healthy hosts left
+func (s endpointSet) pick(identity string, checker *healthChecker, needDiscovery bool) (chosenEndpoints, bool) {
+
+	// non-sticky groups pick at random
+	if !s.Sticky {
+
+		identity = ""
+
+	}
+
+	// only use the hosts that are up
+	var (
+		discovery = s.Discovery.healthy(checker)
+		api       = s.API.healthy(checker)
+		wiiu      = s.WiiU.healthy(checker)
+		n3ds      = s.N3DS.healthy(checker)
+	)
+
+	// check that there are some
+	if len(api) == 0 || len(wiiu) == 0 || len(n3ds) == 0 || (needDiscovery && len(discovery) == 0) {
+
+		return chosenEndpoints{}, false
+
+	}
+
+	return chosenEndpoints{
+		Discovery: discovery.pick("discovery", identity),
+		API:       api.pick("api", identity),
+		WiiU:      wiiu.pick("wiiu", identity),
+		N3DS:      n3ds.pick("3ds", identity),
+	}, true
+
+}
+
+// resolveEndpoints picks hosts from a group, moving on to its fallback group for as long as
+// the group has endpoints without healthy hosts. it returns the group the hosts came from,
+// and fails if it runs out of groups
+func resolveEndpoints(groups map[string]endpointSet, group, identity string, checker *healthChecker, needDiscovery bool) (string, chosenEndpoints, bool) {
+
+	// the groups we've been through, so fallbacks can't loop forever
+	visited := map[string]bool{}
+
+	// keep going until we find one that is up
+	for group != "" && !visited[group] {
+
+		visited[group] = true
+
+		// try to pick hosts from the group
+		set := groups[group]
+		if chosen, ok := set.pick(identity, checker, needDiscovery); ok {
+
+			return group, chosen, true
+
+		}
+
+		// otherwise, move on to the fallback
+		log.Printf("-> endpoints group %s has no healthy hosts, falling back to %q\n", group, set.Fallback)
+		group = set.Fallback
+
+	}
+
+	return group, chosenEndpoints{}, false
+
+}
@@ -0,0 +1,257 @@
+/*
+
+discovery/endpoints_test.go
+
+tests for picking hosts and falling back to other endpoints groups
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"testing"
+)
+
+// testEndpointSet is a group with a single host for each endpoint, all starting with a prefix
+func testEndpointSet(prefix, fallback string) endpointSet {
+
+	return endpointSet{
+		Discovery: hostPool{{Host: prefix + ".discovery", Weight: 1}},
+		API:       hostPool{{Host: prefix + ".api", Weight: 1}},
+		WiiU:      hostPool{{Host: prefix + ".wiiu", Weight: 1}},
+		N3DS:      hostPool{{Host: prefix + ".3ds", Weight: 1}},
+		Fallback:  fallback,
+	}
+
+}
+
+// downChecker is a health checker that has seen the hosts given fail
+func downChecker(groups map[string]endpointSet, down ...string) *healthChecker {
+
+	checker := newHealthChecker(healthCheckOptions{Failures: 1}, groups)
+	for _, host := range down {
+
+		checker.record(host, errors.New("connection refused"))
+
+	}
+
+	return checker
+
+}
+
+func TestPickRespectsWeights(t *testing.T) {
+
+	// one host should get three times as many consoles as the other
+	pool := hostPool{{Host: "small", Weight: 1}, {Host: "big", Weight: 3}}
+
+	for _, sticky := range []bool{false, true} {
+
+		// pick for lots of consoles
+		counts := map[string]int{}
+		for i := 0; i < 4000; i++ {
+
+			identity := ""
+			if sticky == true {
+
+				identity = fmt.Sprintf("console-%d", i)
+
+			}
+			counts[pool.pick("api", identity)]++
+
+		}
+
+		// the split has to be close to the weights
+		if len(counts) != 2 || counts["big"] < 2700 || counts["big"] > 3300 {
+
+			t.Errorf("expected about 3000 of 4000 consoles to get the big host (sticky: %v), got %v", sticky, counts)
+
+		}
+
+	}
+
+	// hosts without a weight never get picked
+	pool = hostPool{{Host: "unused", Weight: 0}, {Host: "used", Weight: 1}}
+	for i := 0; i < 100; i++ {
+
+		if host := pool.pick("api", fmt.Sprintf("console-%d", i)); host != "used" {
+
+			t.Fatalf("expected a host with no weight to never be picked, got %s", host)
+
+		}
+
+	}
+
+	// and there's nothing to pick from a pool without any
+	if host := (hostPool{{Host: "unused", Weight: 0}}).pick("api", ""); host != "" {
+
+		t.Errorf("expected nothing to be picked from a pool without weights, got %s", host)
+
+	}
+
+}
+
+func TestStickyGroupsPickTheSameHosts(t *testing.T) {
+
+	// a group with a few hosts for each endpoint
+	pool := hostPool{{Host: "one", Weight: 1}, {Host: "two", Weight: 2}, {Host: "three", Weight: 1}}
+	set := endpointSet{Discovery: pool, API: pool, WiiU: pool, N3DS: pool, Sticky: true}
+
+	// every console has to get the same hosts every time
+	spread := map[string]bool{}
+	for i := 0; i < 50; i++ {
+
+		identity := fmt.Sprintf("console-%d", i)
+		first, ok := set.pick(identity, nil, true)
+		if ok == false {
+
+			t.Fatal("expected hosts to be picked")
+
+		}
+		for j := 0; j < 10; j++ {
+
+			if again, _ := set.pick(identity, nil, true); again != first {
+
+				t.Fatalf("expected %s to get %+v every time, got %+v", identity, first, again)
+
+			}
+
+		}
+		spread[first.API] = true
+
+	}
+
+	// while different consoles are still spread over the hosts
+	if len(spread) != len(pool) {
+
+		t.Errorf("expected the consoles to be spread over every host, got %v", spread)
+
+	}
+
+	// groups that aren't sticky ignore the identity
+	set.Sticky = false
+	picked := map[string]bool{}
+	for i := 0; i < 100; i++ {
+
+		chosen, _ := set.pick("console-0", nil, true)
+		picked[chosen.API] = true
+
+	}
+	if len(picked) == 1 {
+
+		t.Errorf("expected a group that isn't sticky to pick different hosts for the same console, got %v", picked)
+
+	}
+
+}
+
+func TestResolveEndpointsFallsBack(t *testing.T) {
+
+	// the log isn't needed
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+
+	// default falls back to backup, which has nothing to fall back to, and the
+	// other two fall back to each other
+	groups := map[string]endpointSet{
+		"default": testEndpointSet("default", "backup"),
+		"backup":  testEndpointSet("backup", ""),
+		"ping":    testEndpointSet("ping", "pong"),
+		"pong":    testEndpointSet("pong", "ping"),
+	}
+
+	for _, test := range []struct {
+		name          string
+		group         string
+		down          []string
+		needDiscovery bool
+		expected      string
+		up            bool
+	}{
+		{"every host is up", "default", nil, true, "default", true},
+		{"a role is down", "default", []string{"default.api"}, true, "backup", true},
+		{"another role is down", "default", []string{"default.3ds"}, true, "backup", true},
+		{"discovery is down but isn't needed", "default", []string{"default.discovery"}, false, "default", true},
+		{"discovery is down and is needed", "default", []string{"default.discovery"}, true, "backup", true},
+		{"the fallback is down too", "default", []string{"default.api", "backup.wiiu"}, true, "", false},
+		{"a loop with one group up", "ping", []string{"ping.api"}, true, "pong", true},
+		{"a loop with every group down", "ping", []string{"ping.api", "pong.api"}, true, "", false},
+	} {
+
+		group, chosen, up := resolveEndpoints(groups, test.group, "", downChecker(groups, test.down...), test.needDiscovery)
+		if up != test.up {
+
+			t.Errorf("%s: expected up to be %v, got %v", test.name, test.up, up)
+			continue
+
+		}
+		if up == false {
+
+			continue
+
+		}
+
+		// the hosts have to come from the group it landed on
+		if group != test.expected || chosen.API != group+".api" || chosen.WiiU != group+".wiiu" || chosen.N3DS != group+".3ds" {
+
+			t.Errorf("%s: expected the hosts of %s, got %s with %+v", test.name, test.expected, group, chosen)
+
+		}
+
+	}
+
+}
+
+func TestDiscoveryHandlerWithoutHealthyGroups(t *testing.T) {
+
+	// a config whose only group is down
+	config, err := parseConfig([]byte(stateTestConfig("a")))
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+	defer func(secret string, override bool) {
+
+		fingerprintSecret, overrideDiscovery = secret, override
+
+	}(fingerprintSecret, overrideDiscovery)
+	fingerprintSecret, overrideDiscovery = config.Options.FingerprintSecret, true
+	state := newState(config)
+	state.health = downChecker(config.Endpoints, "a.api")
+	storeState(state)
+	defer storeState(&discoveryState{})
+
+	// the log isn't needed
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+
+	// make a request
+	r := httptest.NewRequest("GET", "/miiverse/xml", nil)
+	r.Header.Set("X-Nintendo-Servicetoken", "ZmluZQ==")
+	w := httptest.NewRecorder()
+	discoveryHandler(w, r)
+
+	// they have to be told to come back later
+	var response result
+	if err := xml.Unmarshal(w.Body.Bytes(), &response); err != nil {
+
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+
+	}
+	if response.HasError != 1 || response.ErrorCode != 3 || response.Message != "SERVICE_MAINTENANCE" || response.APIHost != "" {
+
+		t.Errorf("expected the maintenance error, got %+v", response)
+
+	}
+
+}
@@ -0,0 +1,377 @@
+/*
+
+discovery/env.go
+
+filling the config in from environment variables, so secrets don't
+have to be kept in it and several instances can share one
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	// externals
+	"gopkg.in/yaml.v3"
+)
+
+// the prefix of the environment variables that override options
+const envPrefix = "DISCOVERY_"
+
+// envOption is an option that can be set from the environment even if it isn't in the
+// config. strings are taken as is, and sections list the options in them
+type envOption struct {
+	isString bool
+	section  map[string]envOption
+}
+
+// the options of a url that data is pulled from, when it's written as a mapping
+var envSourceOptions = map[string]envOption{
+	"url":         {isString: true},
+	"file":        {isString: true},
+	"bearerToken": {isString: true},
+	"basicAuth": {section: map[string]envOption{
+		"username": {isString: true},
+		"password": {isString: true},
+	}},
+	"caFile":          {isString: true},
+	"certFile":        {isString: true},
+	"keyFile":         {isString: true},
+	"publicKeys":      {},
+	"signatureHeader": {isString: true},
+	"signatureMaxAge": {},
+}
+
+// the options of the maintenance status, which can also be pulled from a url
+var envMaintenanceOptions = map[string]envOption{
+	"inMaintenance": {},
+	"message":       {isString: true},
+	"scopes":        {},
+	"windows":       {},
+}
+
+// the options that can be set from the environment. these have to be kept in sync with
+// the keys the config decoder reads. anything else is read as yaml
+var envOptions = map[string]envOption{
+	"https":                 {},
+	"port":                  {},
+	"endpoint":              {isString: true},
+	"logfile":               {isString: true},
+	"hashCost":              {},
+	"fingerprintSecret":     {isString: true},
+	"matchRawServicetokens": {},
+	"overrideDiscovery":     {},
+	"maintenance":           {section: mergeEnvOptions(envSourceOptions, envMaintenanceOptions)},
+	"maintenanceBypass": {section: map[string]envOption{
+		"tokens":   {},
+		"groups":   {},
+		"networks": {},
+		"group":    {isString: true},
+	}},
+	"bans":           {section: envSourceOptions},
+	"ipBans":         {section: envSourceOptions},
+	"trustedProxies": {},
+	"proxyProtocol":  {},
+	"healthCheck": {section: map[string]envOption{
+		"type":     {isString: true},
+		"path":     {isString: true},
+		"https":    {},
+		"port":     {},
+		"interval": {},
+		"timeout":  {},
+		"failures": {},
+	}},
+	"status": {section: map[string]envOption{
+		"endpoint": {isString: true},
+		"token":    {isString: true},
+	}},
+	"webhook": {section: map[string]envOption{
+		"endpoint": {isString: true},
+		"secret":   {isString: true},
+		"maxSkew":  {},
+	}},
+	"cache": {section: map[string]envOption{
+		"maintenanceTimeout": {},
+		"banlistTimeout":     {},
+		"ipBansTimeout":      {},
+		"groupdefsTimeout":   {},
+		"rolloutsTimeout":    {},
+		"directory":          {isString: true},
+		"waitForData":        {},
+		"requestTimeout":     {},
+		"maxBackoff":         {},
+		"maxAge":             {},
+		"stalePolicy":        {isString: true},
+	}},
+	"reloadOnChange": {},
+}
+
+// matches ${NAME} and ${NAME:-default} in the config
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// envName turns the key of an option into the name of the environment variable that
+// overrides it (hashCost becomes HASH_COST)
+func envName(key string) string {
+
+	// the name
+	var name strings.Builder
+
+	// split the words up
+	for i, char := range key {
+
+		if i > 0 && unicode.IsUpper(char) && !unicode.IsUpper(rune(key[i-1])) {
+
+			name.WriteRune('_')
+
+		}
+		name.WriteRune(unicode.ToUpper(char))
+
+	}
+
+	return name.String()
+
+}
+
+// mergeEnvOptions combines the options of several sections
+func mergeEnvOptions(sections ...map[string]envOption) map[string]envOption {
+
+	// the combined options
+	merged := map[string]envOption{}
+	for _, section := range sections {
+
+		for key, option := range section {
+
+			merged[key] = option
+
+		}
+
+	}
+
+	return merged
+
+}
+
+// setScalar replaces the value of a scalar. values that weren't quoted or tagged have
+// their type worked out again, so a number replaced with a number is still a number
+func setScalar(node *yaml.Node, value string) {
+
+	node.Value = value
+	if node.Style == 0 {
+
+		node.Tag = ""
+		node.Tag = node.ShortTag()
+
+	}
+
+}
+
+// setLine makes a node and everything in it point at a line, so problems with values
+// that came from the environment are shown where they would be in the config
+func setLine(node *yaml.Node, line, column int) {
+
+	node.Line, node.Column = line, column
+	for _, child := range node.Content {
+
+		setLine(child, line, column)
+
+	}
+
+}
+
+// envValue decodes the value of an environment variable that overrides an option.
+// options that are strings are taken as is, since secrets can look like anything,
+// while anything else is read as yaml, so lists can be written like [a, b]. options
+// that can be either, like a source that is a url or a mapping, are read as yaml but
+// can still be used as strings
+func (d *configDecoder) envValue(name, override string, at *yaml.Node, path string, isString bool) *yaml.Node {
+
+	// strings are taken as is
+	if isString == true {
+
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: override, Line: at.Line, Column: at.Column}
+
+	}
+
+	// anything else is read as yaml
+	var document yaml.Node
+	if err := yaml.Unmarshal([]byte(override), &document); err != nil {
+
+		d.fail(at, path, "%s isn't valid yaml: %v", name, err)
+		return at
+
+	}
+
+	// an empty variable is an empty string
+	if len(document.Content) == 0 {
+
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Line: at.Line, Column: at.Column}
+
+	}
+
+	value := document.Content[0]
+	setLine(value, at.Line, at.Column)
+	d.fromEnv[value] = true
+	return value
+
+}
+
+// substituteEnv replaces ${NAME} in every value in the config with the environment
+// variable NAME, or the default after :- if it isn't set
+func (d *configDecoder) substituteEnv(node *yaml.Node, path string) {
+
+	switch node.Kind {
+
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+
+			d.substituteEnv(node.Content[i+1], joinPath(path, node.Content[i].Value))
+
+		}
+
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+
+			d.substituteEnv(item, fmt.Sprintf("%s[%d]", path, i))
+
+		}
+
+	case yaml.ScalarNode:
+		// check if there's anything to replace
+		if !envReference.MatchString(node.Value) {
+
+			return
+
+		}
+
+		// replace each of them
+		value := envReference.ReplaceAllStringFunc(node.Value, func(reference string) string {
+
+			match := envReference.FindStringSubmatch(reference)
+			if value, ok := os.LookupEnv(match[1]); ok {
+
+				return value
+
+			}
+			if match[2] != "" {
+
+				return match[3]
+
+			}
+
+			d.fail(node, path, "the environment variable %s is not set", match[1])
+			return ""
+
+		})
+		setScalar(node, value)
+
+	}
+
+}
+
+// overrideOptions replaces options with the DISCOVERY_ environment variables named
+// after them, like DISCOVERY_PORT for options.port or DISCOVERY_CACHE_MAX_AGE for
+// options.cache.maxAge, adding the ones that aren't in the config
+func (d *configDecoder) overrideOptions(root *yaml.Node) {
+
+	// find the options
+	if root.Kind != yaml.MappingNode {
+
+		return
+
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+
+		if root.Content[i].Value == "options" && root.Content[i+1].Kind == yaml.MappingNode {
+
+			d.overrideMapping(root.Content[i+1], "options", envPrefix, envOptions)
+
+		}
+
+	}
+
+}
+
+// overrideMapping replaces the values of a mapping with the environment variables
+// named after them, and adds the known options that aren't in it but have one set
+func (d *configDecoder) overrideMapping(node *yaml.Node, path, prefix string, known map[string]envOption) {
+
+	// the options that are there
+	present := map[string]bool{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+
+		// the name of the variable
+		key, value := node.Content[i].Value, node.Content[i+1]
+		name := prefix + envName(key)
+		present[key] = true
+
+		// values are replaced as a whole
+		if override, ok := os.LookupEnv(name); ok {
+
+			node.Content[i+1] = d.envValue(name, override, value, joinPath(path, key), known[key].isString)
+
+		} else if value.Kind == yaml.MappingNode {
+
+			// or a value at a time, for mappings
+			d.overrideMapping(value, joinPath(path, key), name+"_", known[key].section)
+
+		}
+
+	}
+
+	// add the rest, in order so problems are too
+	keys := make([]string, 0, len(known))
+	for key := range known {
+
+		keys = append(keys, key)
+
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+
+		if present[key] == true {
+
+			continue
+
+		}
+
+		// the option itself
+		name := prefix + envName(key)
+		if override, ok := os.LookupEnv(name); ok {
+
+			node.Content = append(node.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key, Line: node.Line, Column: node.Column},
+				d.envValue(name, override, node, joinPath(path, key), known[key].isString),
+			)
+			continue
+
+		}
+
+		// or the options in a section of them
+		if known[key].section == nil {
+
+			continue
+
+		}
+		section := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: node.Line, Column: node.Column}
+		d.overrideMapping(section, joinPath(path, key), name+"_", known[key].section)
+		if len(section.Content) != 0 {
+
+			node.Content = append(node.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key, Line: node.Line, Column: node.Column},
+				section,
+			)
+
+		}
+
+	}
+
+}
@@ -0,0 +1,196 @@
+/*
+
+discovery/env_test.go
+
+tests for filling the config in from environment variables
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// a config with only the options that are required
+const envTestConfig = `
+options:
+  https: false
+  port: ${PORT:-5432}
+  endpoint: "/miiverse/xml"
+  logfile: "${LOG_DIRECTORY}/discovery.log"
+  hashCost: 4
+  overrideDiscovery: false
+  maintenance: false
+endpoints:
+  default: {discovery: d, api: a, wiiu: w, 3ds: n}
+`
+
+func TestEnvName(t *testing.T) {
+
+	for key, expected := range map[string]string{
+		"port":              "PORT",
+		"hashCost":          "HASH_COST",
+		"fingerprintSecret": "FINGERPRINT_SECRET",
+		"ipBansTimeout":     "IP_BANS_TIMEOUT",
+		"healthCheck":       "HEALTH_CHECK",
+	} {
+
+		if name := envName(key); name != expected {
+
+			t.Errorf("%s: expected %s, got %s", key, expected, name)
+
+		}
+
+	}
+
+}
+
+func TestSubstituteEnv(t *testing.T) {
+
+	// a set variable and a default
+	t.Setenv("LOG_DIRECTORY", "/var/log")
+	config, err := parseConfig([]byte(envTestConfig))
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+	if config.Options.Logfile != "/var/log/discovery.log" || config.Options.Port != 5432 {
+
+		t.Fatalf("expected the variable and the default, got %q and %d", config.Options.Logfile, config.Options.Port)
+
+	}
+
+	// numbers are still numbers
+	t.Setenv("PORT", "5433")
+	if config, err = parseConfig([]byte(envTestConfig)); err != nil || config.Options.Port != 5433 {
+
+		t.Fatalf("expected port 5433, got %v", err)
+
+	}
+
+	// a variable that isn't set, without a default, is a problem
+	if _, err = parseConfig([]byte(strings.Replace(envTestConfig, "${LOG_DIRECTORY}", "${DISCOVERY_TEST_UNSET}", 1))); err == nil || !strings.Contains(err.Error(), "DISCOVERY_TEST_UNSET is not set") {
+
+		t.Fatalf("expected an error about the unset variable, got %v", err)
+
+	}
+
+}
+
+func TestOverrideOptions(t *testing.T) {
+
+	// options that are in the config, options that aren't and options in sections that aren't
+	t.Setenv("LOG_DIRECTORY", "/var/log")
+	t.Setenv("DISCOVERY_PORT", "5433")
+	t.Setenv("DISCOVERY_LOGFILE", "other.log")
+	t.Setenv("DISCOVERY_FINGERPRINT_SECRET", " #this-is-not-a-comment ")
+	t.Setenv("DISCOVERY_CACHE_MAX_AGE", "600")
+	t.Setenv("DISCOVERY_CACHE_DIRECTORY", "0123")
+	t.Setenv("DISCOVERY_HEALTH_CHECK_INTERVAL", "30")
+	t.Setenv("DISCOVERY_TRUSTED_PROXIES", "[10.0.0.1, 10.0.0.2]")
+
+	config, err := parseConfig([]byte(envTestConfig))
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+	if config.Options.Port != 5433 || config.Options.Logfile != "other.log" {
+
+		t.Errorf("expected the options in the config to be replaced, got %d and %q", config.Options.Port, config.Options.Logfile)
+
+	}
+	if config.Options.FingerprintSecret != " #this-is-not-a-comment " {
+
+		t.Errorf("expected the fingerprint secret to be taken as is, got %q", config.Options.FingerprintSecret)
+
+	}
+	if config.Options.Cache.Fetch.MaxAge != 600 || config.Options.Cache.Directory != "0123" {
+
+		t.Errorf("expected the cache options to be added, got %+v", config.Options.Cache)
+
+	}
+	if config.Options.HealthCheck == nil || config.Options.HealthCheck.Interval != 30 {
+
+		t.Errorf("expected the health check to be added, got %+v", config.Options.HealthCheck)
+
+	}
+	if len(config.Options.TrustedProxies) != 2 {
+
+		t.Errorf("expected 2 trusted proxies, got %v", config.Options.TrustedProxies)
+
+	}
+
+	// values that aren't valid are problems in the config
+	t.Setenv("DISCOVERY_HASH_COST", "lots")
+	if _, err = parseConfig([]byte(envTestConfig)); err == nil || !strings.Contains(err.Error(), "options.hashCost") {
+
+		t.Fatalf("expected an error about options.hashCost, got %v", err)
+
+	}
+
+}
+
+func TestOverrideOptionsOnlyTakesStringsLiterally(t *testing.T) {
+
+	// a maintenance status that is pulled from a url can be turned into a boolean
+	config := strings.Replace(envTestConfig, "maintenance: false", `maintenance: "https://moderation.your-host.xyz/maintenance"`, 1)
+	t.Setenv("LOG_DIRECTORY", "/var/log")
+	t.Setenv("DISCOVERY_MAINTENANCE", "true")
+	parsed, err := parseConfig([]byte(config))
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+	if parsed.Options.Maintenance.URL != "" || parsed.Options.Maintenance.Status.InMaintenance != true {
+
+		t.Fatalf("expected maintenance to be on, got %+v", parsed.Options.Maintenance)
+
+	}
+
+	// and the url of a source is still taken as is
+	t.Setenv("DISCOVERY_MAINTENANCE", "")
+	os.Unsetenv("DISCOVERY_MAINTENANCE")
+	t.Setenv("DISCOVERY_BANS_URL", "https://moderation.your-host.xyz/bans#everyone")
+	if parsed, err = parseConfig([]byte(config)); err != nil {
+
+		t.Fatal(err)
+
+	}
+	if parsed.Options.Bans.URL != "https://moderation.your-host.xyz/bans#everyone" {
+
+		t.Fatalf("expected the url of the bans to be added, got %q", parsed.Options.Bans.URL)
+
+	}
+
+}
+
+func TestEnvOptionsMatchOptionKeys(t *testing.T) {
+
+	// every option the decoder reads can be set from the environment
+	keys := []string{}
+	for key := range envOptions {
+
+		keys = append(keys, key)
+
+	}
+	expected := append([]string{}, optionKeys...)
+	sort.Strings(keys)
+	sort.Strings(expected)
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+
+		t.Fatalf("envOptions has %v, but the options are %v", keys, expected)
+
+	}
+
+}
@@ -0,0 +1,334 @@
+/*
+
+discovery/fetch.go
+
+pulling data from urls without downloading it again when it hasn't
+changed, and backing off when they're down
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// fetchOptions controls how data is pulled from urls
+type fetchOptions struct {
+	RequestTimeout int
+	MaxBackoff     int
+	MaxAge         int
+	StalePolicy    string
+}
+
+// sourceStatus is what we know about a source that is pulled from a url
+type sourceStatus struct {
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	LastChange  time.Time `json:"lastChange"`
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"lastError,omitempty"`
+	Age         string    `json:"age,omitempty"`
+	Stale       bool      `json:"stale"`
+	Policy      string    `json:"policy"`
+}
+
+// fetcher pulls a single source from its url
+type fetcher struct {
+	source       remoteSource
+	options      fetchOptions
+	client       *http.Client
+	etag         string
+	lastModified string
+	signature    string
+	timestamp    string
+	current      time.Time
+	lock         sync.RWMutex
+	dirty        bool
+	status       sourceStatus
+}
+
+// newFetcher creates a fetcher for a url
+func newFetcher(name string, source remoteSource, settings fetchOptions) *fetcher {
+
+	// the client
+	client := &http.Client{Timeout: time.Duration(settings.RequestTimeout) * time.Second}
+
+	// use the certificates the source needs, if it needs any
+	if source.TLS != nil {
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = source.TLS
+		client.Transport = transport
+
+	}
+
+	return &fetcher{
+		source:  source,
+		options: settings,
+		client:  client,
+		status:  sourceStatus{Name: name, URL: source.URL, Policy: settings.StalePolicy},
+	}
+
+}
+
+// fetch pulls the data from the url. it returns no data if the url says it hasn't
+// changed since the last time
+func (f *fetcher) fetch() ([]byte, error) {
+
+	// make the request
+	req, err := http.NewRequest("GET", f.source.URL, nil)
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	// authenticate
+	for key, value := range f.source.Headers {
+
+		req.Header.Set(key, value)
+
+	}
+	if f.source.Username != "" || f.source.Password != "" {
+
+		req.SetBasicAuth(f.source.Username, f.source.Password)
+
+	}
+
+	// only ask for the data if it changed
+	if f.etag != "" {
+
+		req.Header.Set("If-None-Match", f.etag)
+
+	}
+	if f.lastModified != "" {
+
+		req.Header.Set("If-Modified-Since", f.lastModified)
+
+	}
+
+	// send it
+	res, err := f.client.Do(req)
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	// close request body stream once finished
+	defer res.Body.Close()
+
+	// check if it changed
+	if res.StatusCode == http.StatusNotModified {
+
+		return nil, nil
+
+	}
+
+	// anything but a success isn't data
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+
+		return nil, fmt.Errorf("got status %s", res.Status)
+
+	}
+
+	// read all data from body
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	// make sure it was signed by someone we trust, and isn't older than what we have
+	signature := res.Header.Get(f.source.SignatureHeader)
+	timestamp := res.Header.Get(signatureTimestampHeader(f.source.SignatureHeader))
+	if len(f.source.PublicKeys) != 0 {
+
+		if _, err := verifySignature(f.source.PublicKeys, data, signature, timestamp, f.signedAt(), f.source.SignatureMaxAge, time.Now()); err != nil {
+
+			return nil, fmt.Errorf("rejected the data: %v", err)
+
+		}
+
+	}
+	f.signature, f.timestamp = signature, timestamp
+
+	// remember what to send next time
+	f.etag = res.Header.Get("ETag")
+	f.lastModified = res.Header.Get("Last-Modified")
+
+	return data, nil
+
+}
+
+// forget makes the next request download the data again, even if the url says it
+// hasn't changed, which is needed when the data it sent couldn't be used
+func (f *fetcher) forget() {
+
+	f.etag = ""
+	f.lastModified = ""
+
+}
+
+// signedAt returns the time the data we have was signed at, if it was signed
+func (f *fetcher) signedAt() time.Time {
+
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.current
+
+}
+
+// applied records the time the data we now have was signed at, so older data is refused
+func (f *fetcher) applied(timestamp string) {
+
+	// unsigned data doesn't have one
+	signedAt, err := parseSignatureTimestamp(timestamp)
+	if err != nil {
+
+		return
+
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.current = signedAt
+
+}
+
+// invalidate makes the next pull apply the data again, even if it hasn't changed,
+// which is needed when the data was changed some other way
+func (f *fetcher) invalidate() {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.dirty = true
+
+}
+
+// invalidated checks if the data was changed some other way since the last pull
+func (f *fetcher) invalidated() bool {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	dirty := f.dirty
+	f.dirty = false
+	return dirty
+
+}
+
+// succeeded records that the source has data that is up to date as of a time
+func (f *fetcher) succeeded(at time.Time, changed bool) {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.status.LastSuccess = at
+	f.status.Failures = 0
+	f.status.LastError = ""
+	if changed {
+
+		f.status.LastChange = at
+
+	}
+
+}
+
+// failed records that pulling the source failed, returning how many times it has in a row
+func (f *fetcher) failed(err error) int {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.status.Failures++
+	f.status.LastError = err.Error()
+	return f.status.Failures
+
+}
+
+// attempted records that the source is about to be pulled
+func (f *fetcher) attempted(at time.Time) {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.status.LastAttempt = at
+
+}
+
+// stale checks if the data hasn't been confirmed to be up to date for longer than allowed
+func (f *fetcher) stale(now time.Time) bool {
+
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.options.MaxAge > 0 && now.Sub(f.status.LastSuccess) > time.Duration(f.options.MaxAge)*time.Second
+
+}
+
+// report returns what we know about the source
+func (f *fetcher) report(now time.Time) sourceStatus {
+
+	f.lock.RLock()
+	status := f.status
+	f.lock.RUnlock()
+
+	// work out how old the data is
+	if !status.LastSuccess.IsZero() {
+
+		status.Age = now.Sub(status.LastSuccess).Truncate(time.Second).String()
+
+	}
+	status.Stale = f.stale(now)
+
+	return status
+
+}
+
+// backoff returns how long to wait after a number of failures in a row. it doubles
+// with each failure, up to the maximum, and is jittered so a lot of discovery
+// instances don't all retry at once
+func (f *fetcher) backoff(timeout, failures int) time.Duration {
+
+	// double it for each failure
+	delay := time.Duration(timeout) * time.Second
+	limit := time.Duration(f.options.MaxBackoff) * time.Second
+	for i := 1; i < failures && delay < limit; i++ {
+
+		delay *= 2
+
+	}
+	if delay > limit {
+
+		delay = limit
+
+	}
+
+	// wait somewhere between half of it and all of it
+	half := int64(delay / 2)
+	if half <= 0 {
+
+		return delay
+
+	}
+
+	return time.Duration(half + rand.Int63n(half+1))
+
+}
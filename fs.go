@@ -207,7 +207,7 @@ func checkJSONValidity(file string) (bool, error) {
 	filebyte := []byte(filedata)
 
 	// this only exists because it's required to unmarshal the file
-	var data map[string]interface{}
+	var data interface{}
 
 	// unmarshal the file
 	err = json.Unmarshal(filebyte, &data)
@@ -261,10 +261,11 @@ func readJSONFile(file string) (map[string]interface{}, error) {
 
 }
 
-// write to a json file
-func writeJSONFile(file string, data map[string]int) error {
+// write to a json file. the data is written to a temporary file first and then
+// moved into place, so the file is never left half-written
+func writeJSONFile(file string, data interface{}) error {
 
-	// turn go map into valid JSON
+	// turn go data into valid JSON
 	fileData, err := json.Marshal(data)
 
 	// handle errors
@@ -275,13 +276,18 @@ func writeJSONFile(file string, data map[string]int) error {
 
 	}
 
-	// convert to string
-	sFileData := string(fileData)
+	// write it to a temporary file next to it
+	err = writeByteToFile(file+".tmp", fileData)
 
-	// write it to a file
-	writeFile(file, sFileData)
+	// handle errors
+	if err != nil {
 
-	// return no error
-	return nil
+		// return it
+		return err
+
+	}
+
+	// move it into place
+	return os.Rename(file+".tmp", file)
 
 }
@@ -0,0 +1,348 @@
+/*
+
+discovery/hashtoken.go
+
+the hash-token command, which turns servicetokens into
+entries for the bans and the groupdefs
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	// externals
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hashTokenCommand runs `discovery hash-token` and returns the exit status
+func hashTokenCommand(args []string) int {
+
+	// the flags of the command
+	var (
+		flags      = flag.NewFlagSet("hash-token", flag.ContinueOnError)
+		configFile = flags.String("config", "config.yaml", "config file to read the fingerprint secret and hash cost from, if they aren't given")
+		secret     = flags.String("secret", os.Getenv(envPrefix+envName("fingerprintSecret")), "fingerprint secret to hash with, instead of the one in the config (defaults to $"+envPrefix+envName("fingerprintSecret")+")")
+		cost       = flags.Int("cost", 0, "bcrypt cost to hash with, instead of the hashCost in the config (for -bcrypt)")
+		kind       = flags.String("kind", "ban", "kind of entry to print, either ban or groupdef")
+		reason     = flags.String("reason", "", "reason shown to banned users (for -kind ban)")
+		expires    = flags.String("expires", "", "when the bans end, either as a timestamp like 2006-01-02T15:04:05Z or a duration like 72h (for -kind ban)")
+		issuer     = flags.String("issuer", "", "who is making the bans (for -kind ban)")
+		group      = flags.String("group", "", "endpoints group to send the users to (for -kind groupdef)")
+		format     = flags.String("format", "yaml", "format to print the entries in, either yaml (for config.yaml) or json (for a remote url)")
+		useBcrypt  = flags.Bool("bcrypt", false, "print legacy bcrypt hashes instead of fingerprints")
+		decoded    = flags.Bool("decoded", false, "the servicetokens are already decoded instead of being X-Nintendo-Servicetoken headers")
+	)
+
+	// explain how to use it
+	flags.Usage = func() {
+
+		fmt.Fprintf(flags.Output(), "usage: discovery hash-token [flags] [servicetoken...]\n\n")
+		fmt.Fprintf(flags.Output(), "hashes servicetokens the same way the server does and prints entries ready to be\n")
+		fmt.Fprintf(flags.Output(), "used as bans or groupdefs. servicetokens are read from stdin, one per line, if none\n")
+		fmt.Fprintf(flags.Output(), "are given.\n\n")
+		flags.PrintDefaults()
+
+	}
+
+	// parse them
+	if err := flags.Parse(args); err != nil {
+
+		return 2
+
+	}
+
+	// check that they make sense
+	if *kind != "ban" && *kind != "groupdef" {
+
+		fmt.Fprintf(os.Stderr, "[err]: -kind must be either ban or groupdef\n")
+		return 2
+
+	}
+	if *format != "yaml" && *format != "json" {
+
+		fmt.Fprintf(os.Stderr, "[err]: -format must be either yaml or json\n")
+		return 2
+
+	}
+
+	// the ban that each entry gets
+	issued := time.Now().UTC().Truncate(time.Second)
+	entry := ban{Reason: *reason, Issued: &issued, Issuer: *issuer}
+
+	// figure out when the bans end
+	if *expires != "" {
+
+		// it's either a duration
+		if duration, err := time.ParseDuration(*expires); err == nil {
+
+			end := issued.Add(duration)
+			entry.Expires = &end
+
+		} else if end, err := time.Parse(time.RFC3339, *expires); err == nil {
+
+			// or a timestamp
+			entry.Expires = &end
+
+		} else {
+
+			fmt.Fprintf(os.Stderr, "[err]: -expires must be either a timestamp like 2006-01-02T15:04:05Z or a duration like 72h\n")
+			return 2
+
+		}
+
+	}
+
+	// check the secret and the cost, if they were given
+	if *secret != "" && len(*secret) < 16 {
+
+		fmt.Fprintf(os.Stderr, "[err]: -secret must be at least 16 characters long\n")
+		return 2
+
+	}
+	if *cost != 0 && (*cost < bcrypt.MinCost || *cost > bcrypt.MaxCost) {
+
+		fmt.Fprintf(os.Stderr, "[err]: -cost must be between %d and %d\n", bcrypt.MinCost, bcrypt.MaxCost)
+		return 2
+
+	}
+
+	// the config is only needed for what wasn't given
+	var err error
+	if (*useBcrypt && *cost == 0) || (!*useBcrypt && *secret == "") {
+
+		// load it
+		config, err := loadConfig(*configFile)
+		if err != nil {
+
+			reportConfigError(os.Stdout, *configFile, err)
+			return 1
+
+		}
+
+		// we can only make fingerprints if there's a secret
+		if !*useBcrypt && config.Options.FingerprintSecret == "" {
+
+			fmt.Fprintf(os.Stderr, "[err]: options.fingerprintSecret is not set in %s and -secret wasn't given, so only -bcrypt hashes can be made\n", *configFile)
+			return 1
+
+		}
+
+		// groupdefs have to point at a group that exists
+		if *kind == "groupdef" {
+
+			if _, ok := config.Endpoints[*group]; !ok {
+
+				fmt.Fprintf(os.Stderr, "[err]: -group %q is not one of the endpoints groups in %s\n", *group, *configFile)
+				return 2
+
+			}
+
+		}
+
+		// and fill in what wasn't given
+		if *secret == "" {
+
+			*secret = config.Options.FingerprintSecret
+
+		}
+		if *cost == 0 {
+
+			*cost = config.Options.HashCost
+
+		}
+
+	} else if *kind == "groupdef" && *group == "" {
+
+		// without the config, the group can't be checked, but it has to be there
+		fmt.Fprintf(os.Stderr, "[err]: -group is required for -kind groupdef\n")
+		return 2
+
+	}
+
+	// get the servicetokens
+	tokens := flags.Args()
+	if len(tokens) == 0 {
+
+		tokens, err = readTokens(os.Stdin)
+		if err != nil {
+
+			fmt.Fprintf(os.Stderr, "[err]: unable to read servicetokens from stdin: %v\n", err)
+			return 1
+
+		}
+
+	}
+
+	// the hashed servicetokens, in order
+	keys := []string{}
+
+	// hash each of them
+	for _, servicetoken := range tokens {
+
+		// normalize it like the server does
+		token := servicetoken
+		if !*decoded {
+
+			token, err = normalizeServiceToken(servicetoken)
+			if err != nil {
+
+				fmt.Fprintf(os.Stderr, "[err]: unable to decode servicetoken %q: %v\n", servicetoken, err)
+				return 1
+
+			}
+
+		}
+
+		// hash it
+		key := ""
+		if *useBcrypt {
+
+			key, err = hash(token, *cost)
+			if err != nil {
+
+				fmt.Fprintf(os.Stderr, "[err]: unable to hash servicetoken %q: %v\n", servicetoken, err)
+				return 1
+
+			}
+
+		} else {
+
+			key = fingerprint(token, *secret)
+
+		}
+
+		keys = append(keys, key)
+
+	}
+
+	// print the entries
+	if *format == "json" {
+
+		err = printJSONEntries(os.Stdout, keys, *kind, entry, *group)
+
+	} else {
+
+		printYAMLEntries(os.Stdout, keys, *kind, entry, *group)
+
+	}
+
+	// check for errors
+	if err != nil {
+
+		fmt.Fprintf(os.Stderr, "[err]: unable to print the entries: %v\n", err)
+		return 1
+
+	}
+
+	return 0
+
+}
+
+// readTokens reads servicetokens, one per line, skipping blank lines
+func readTokens(reader io.Reader) ([]string, error) {
+
+	// the servicetokens
+	tokens := []string{}
+
+	// read each line
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+
+		// skip the blank ones
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+
+			tokens = append(tokens, line)
+
+		}
+
+	}
+
+	return tokens, scanner.Err()
+
+}
+
+// printYAMLEntries prints entries indented to be pasted under options.bans or groupdefs
+func printYAMLEntries(writer io.Writer, keys []string, kind string, entry ban, group string) {
+
+	for _, key := range keys {
+
+		// bans go under options, so they're indented one more level
+		if kind == "ban" {
+
+			// the reason is always there
+			fmt.Fprintf(writer, "    %s:\n      reason: %s\n", key, strconv.Quote(entry.Reason))
+
+			// but the rest are optional
+			if entry.Expires != nil {
+
+				fmt.Fprintf(writer, "      expires: %s\n", entry.Expires.Format(time.RFC3339))
+
+			}
+			if entry.Issued != nil {
+
+				fmt.Fprintf(writer, "      issued: %s\n", entry.Issued.Format(time.RFC3339))
+
+			}
+			if entry.Issuer != "" {
+
+				fmt.Fprintf(writer, "      issuer: %s\n", strconv.Quote(entry.Issuer))
+
+			}
+
+		} else {
+
+			fmt.Fprintf(writer, "  %s: %s\n", key, strconv.Quote(group))
+
+		}
+
+	}
+
+}
+
+// printJSONEntries prints entries in the format the remote urls return
+func printJSONEntries(writer io.Writer, keys []string, kind string, entry ban, group string) error {
+
+	// the entries
+	entries := map[string]interface{}{}
+
+	// build them
+	for _, key := range keys {
+
+		if kind == "ban" {
+
+			entries[key] = entry
+
+		} else {
+
+			entries[key] = group
+
+		}
+
+	}
+
+	// encode them
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+
+		return err
+
+	}
+
+	// print them
+	_, err = fmt.Fprintf(writer, "%s\n", data)
+	return err
+
+}
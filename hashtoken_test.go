@@ -0,0 +1,208 @@
+/*
+
+discovery/hashtoken_test.go
+
+tests for the entries printed by the hash-token command
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runHashToken runs the hash-token command and returns what it printed
+func runHashToken(t *testing.T, args ...string) (string, int) {
+
+	// catch what is printed
+	output, err := os.CreateTemp(t.TempDir(), "output")
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+	defer output.Close()
+	defer func(stdout *os.File) { os.Stdout = stdout }(os.Stdout)
+	os.Stdout = output
+
+	// run it
+	status := hashTokenCommand(args)
+
+	// read it back
+	data, err := os.ReadFile(output.Name())
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+
+	return string(data), status
+
+}
+
+func TestHashTokenEntriesCanBeLoaded(t *testing.T) {
+
+	// there is no config, so everything has to come from the flags
+	secret, servicetoken := "a-secret-that-is-long-enough", "YmFubmVk"
+	noConfig := filepath.Join(t.TempDir(), "config.yaml")
+	token, err := normalizeServiceToken(servicetoken)
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+	key := fingerprint(token, secret)
+
+	// the config the yaml entries are pasted into
+	config := strings.Replace(validTestConfig, "  hashCost: 4\n", "  hashCost: 4\n  fingerprintSecret: \""+secret+"\"\n", 1)
+
+	// the log isn't needed
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+
+	// yaml bans go under options.bans
+	output, status := runHashToken(t, "-config", noConfig, "-secret", secret, "-reason", "banned until {expires}", "-expires", "72h", "-issuer", "someone", servicetoken)
+	if status != 0 {
+
+		t.Fatalf("expected the yaml bans to be printed, got status %d and %q", status, output)
+
+	}
+	parsed, err := parseConfig([]byte(strings.Replace(config, "  maintenance: false\n", "  maintenance: false\n  bans:\n"+output, 1)))
+	if err != nil {
+
+		t.Fatalf("unable to load the yaml bans %q: %v", output, err)
+
+	}
+	entry, ok := parsed.Options.Bans.Bans[key]
+	if !ok || entry.Reason != "banned until {expires}" || entry.Issuer != "someone" || entry.Expires == nil || entry.Issued == nil || !entry.Expires.After(*entry.Issued) {
+
+		t.Errorf("expected the ban to be loaded from %q, got %+v", output, parsed.Options.Bans.Bans)
+
+	}
+
+	// yaml groupdefs go under groupdefs
+	output, status = runHashToken(t, "-config", noConfig, "-secret", secret, "-kind", "groupdef", "-group", "other", servicetoken)
+	if status != 0 {
+
+		t.Fatalf("expected the yaml groupdefs to be printed, got status %d and %q", status, output)
+
+	}
+	parsed, err = parseConfig([]byte(config + "groupdefs:\n" + output))
+	if err != nil {
+
+		t.Fatalf("unable to load the yaml groupdefs %q: %v", output, err)
+
+	}
+	if group := parsed.Groupdefs.Groupdefs[key]; group != "other" {
+
+		t.Errorf("expected the groupdef to be loaded from %q, got %+v", output, parsed.Groupdefs.Groupdefs)
+
+	}
+
+	// json bans are what the remote urls return
+	fingerprintSecret = secret
+	defer func() { fingerprintSecret = "" }()
+	storeState(newState(parsed))
+	defer storeState(&discoveryState{})
+	output, status = runHashToken(t, "-config", noConfig, "-secret", secret, "-format", "json", "-reason", "banned", servicetoken)
+	if status != 0 {
+
+		t.Fatalf("expected the json bans to be printed, got status %d and %q", status, output)
+
+	}
+	if err := applyBans([]byte(output)); err != nil {
+
+		t.Fatalf("unable to apply the json bans %q: %v", output, err)
+
+	}
+	state := loadState()
+	if found, banned := state.banIndex.lookup(key, []string{token}); !banned || state.bans[found].Reason != "banned" {
+
+		t.Errorf("expected the servicetoken to be banned by %q", output)
+
+	}
+
+	// and so are json groupdefs
+	output, status = runHashToken(t, "-config", noConfig, "-secret", secret, "-format", "json", "-kind", "groupdef", "-group", "other", servicetoken)
+	if status != 0 {
+
+		t.Fatalf("expected the json groupdefs to be printed, got status %d and %q", status, output)
+
+	}
+	if err := applyGroupdefs([]byte(output)); err != nil {
+
+		t.Fatalf("unable to apply the json groupdefs %q: %v", output, err)
+
+	}
+	state = loadState()
+	if found, match := state.groupdefsIndex.lookup(key, []string{token}); !match || state.groupdefs[found] != "other" {
+
+		t.Errorf("expected the servicetoken to be put in the other group by %q", output)
+
+	}
+
+	// legacy hashes only need the cost
+	output, status = runHashToken(t, "-config", noConfig, "-bcrypt", "-cost", "4", "-format", "json", "-reason", "banned", servicetoken)
+	if status != 0 {
+
+		t.Fatalf("expected the bcrypt bans to be printed, got status %d and %q", status, output)
+
+	}
+	if err := applyBans([]byte(output)); err != nil {
+
+		t.Fatalf("unable to apply the bcrypt bans %q: %v", output, err)
+
+	}
+	if _, banned := loadState().banIndex.lookup("", []string{token}); !banned {
+
+		t.Errorf("expected the servicetoken to be banned by %q", output)
+
+	}
+
+}
+
+func TestHashTokenFlagProblems(t *testing.T) {
+
+	// there is no config or environment variable to fall back on
+	noConfig := filepath.Join(t.TempDir(), "config.yaml")
+	secret := "a-secret-that-is-long-enough"
+	t.Setenv(envPrefix+envName("fingerprintSecret"), "")
+
+	for _, test := range []struct {
+		name   string
+		args   []string
+		status int
+	}{
+		{"a secret that is too short", []string{"-secret", "short"}, 2},
+		{"a cost that is too high", []string{"-bcrypt", "-cost", "100"}, 2},
+		{"a groupdef without a group", []string{"-secret", secret, "-kind", "groupdef"}, 2},
+		{"no secret and no config", []string{}, 1},
+		{"a secret but no cost for bcrypt and no config", []string{"-secret", secret, "-bcrypt"}, 1},
+	} {
+
+		// the problems are printed to stderr, which isn't checked
+		stderr := os.Stderr
+		os.Stderr, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		_, status := runHashToken(t, append(append([]string{"-config", noConfig}, test.args...), "YmFubmVk")...)
+		os.Stderr.Close()
+		os.Stderr = stderr
+
+		if status != test.status {
+
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, status)
+
+		}
+
+	}
+
+}
@@ -0,0 +1,325 @@
+/*
+
+discovery/health.go
+
+checking that the hosts consoles are sent to are up
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// healthCheckOptions is the healthCheck section of the options
+type healthCheckOptions struct {
+	Type     string
+	Path     string
+	HTTPS    bool
+	Port     int
+	Interval int
+	Timeout  int
+	Failures int
+}
+
+// hostHealth is what we know about a single host
+type hostHealth struct {
+	Host      string    `json:"host"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"failures"`
+	LastCheck time.Time `json:"lastCheck"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// healthChecker periodically probes every host and keeps track of which ones are down
+type healthChecker struct {
+	options healthCheckOptions
+	client  *http.Client
+	lock    sync.RWMutex
+	hosts   map[string]*hostHealth
+	stopped chan struct{}
+}
+
+// newHealthChecker creates a health checker for the hosts of every group
+func newHealthChecker(settings healthCheckOptions, groups map[string]endpointSet) *healthChecker {
+
+	// the checker
+	checker := &healthChecker{
+		options: settings,
+		client: &http.Client{
+			Timeout: time.Duration(settings.Timeout) * time.Second,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+
+				// a redirect still means the host is up
+				return http.ErrUseLastResponse
+
+			},
+		},
+		hosts:   map[string]*hostHealth{},
+		stopped: make(chan struct{}),
+	}
+
+	// every host starts out healthy until it's checked
+	for _, group := range groups {
+
+		for _, pool := range []hostPool{group.Discovery, group.API, group.WiiU, group.N3DS} {
+
+			for _, host := range pool {
+
+				checker.hosts[host.Host] = &hostHealth{Host: host.Host, Healthy: true}
+
+			}
+
+		}
+
+	}
+
+	return checker
+
+}
+
+// healthy checks if a host is up. every host is up if there is no health checker
+func (c *healthChecker) healthy(host string) bool {
+
+	// without a checker, we can't know any better
+	if c == nil {
+
+		return true
+
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	// hosts we don't check are always up
+	state, ok := c.hosts[host]
+	return !ok || state.Healthy
+
+}
+
+// status returns what we know about every host, sorted by host
+func (c *healthChecker) status() []hostHealth {
+
+	// the statuses
+	statuses := []hostHealth{}
+
+	// there are none without a checker
+	if c == nil {
+
+		return statuses
+
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	// copy them
+	for _, state := range c.hosts {
+
+		statuses = append(statuses, *state)
+
+	}
+
+	// sort them
+	sort.Slice(statuses, func(i, j int) bool {
+
+		return statuses[i].Host < statuses[j].Host
+
+	})
+
+	return statuses
+
+}
+
+// start checks every host forever, waiting the interval between each round
+func (c *healthChecker) start() {
+
+	go func() {
+
+		// do this forever
+		for {
+
+			c.checkAll()
+
+			// timeout, unless it was stopped
+			select {
+
+			case <-c.stopped:
+				return
+
+			case <-time.After(time.Duration(c.options.Interval) * time.Second):
+
+			}
+
+		}
+
+	}()
+
+}
+
+// stop stops checking the hosts once the current round is done
+func (c *healthChecker) stop() {
+
+	close(c.stopped)
+
+}
+
+// inherit takes what another checker knows about the hosts they both check, so
+// hosts that are down don't count as up again when the checker is replaced
+func (c *healthChecker) inherit(previous *healthChecker) {
+
+	previous.lock.RLock()
+	defer previous.lock.RUnlock()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for host, state := range previous.hosts {
+
+		if _, ok := c.hosts[host]; ok {
+
+			copied := *state
+			c.hosts[host] = &copied
+
+		}
+
+	}
+
+}
+
+// checkAll probes every host at the same time and records the results
+func (c *healthChecker) checkAll() {
+
+	// the hosts to check
+	c.lock.RLock()
+	hosts := make([]string, 0, len(c.hosts))
+	for host := range c.hosts {
+
+		hosts = append(hosts, host)
+
+	}
+	c.lock.RUnlock()
+
+	// check them
+	var wait sync.WaitGroup
+	for _, host := range hosts {
+
+		wait.Add(1)
+		go func(host string) {
+
+			defer wait.Done()
+			c.record(host, c.probe(host))
+
+		}(host)
+
+	}
+	wait.Wait()
+
+}
+
+// record updates what we know about a host after probing it
+func (c *healthChecker) record(host string, err error) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// get the state
+	state := c.hosts[host]
+	state.LastCheck = time.Now()
+
+	// a single success brings it back
+	if err == nil {
+
+		if !state.Healthy {
+
+			log.Printf("-> %s is healthy again\n", host)
+
+		}
+
+		state.Healthy = true
+		state.Failures = 0
+		state.LastError = ""
+		return
+
+	}
+
+	// otherwise, it's down once it fails enough times in a row
+	state.Failures++
+	state.LastError = err.Error()
+	if state.Healthy && state.Failures >= c.options.Failures {
+
+		log.Printf("[err]: %s is unhealthy after %d failed checks...\n", host, state.Failures)
+		log.Printf("       error: %v\n", err)
+		state.Healthy = false
+
+	}
+
+}
+
+// address adds the port we check to a host, unless it already has one
+func (c *healthChecker) address(host string) string {
+
+	// check if it already has one
+	if _, _, err := net.SplitHostPort(host); err == nil {
+
+		return host
+
+	}
+
+	// otherwise, use the configured one
+	return net.JoinHostPort(host, fmt.Sprint(c.options.Port))
+
+}
+
+// probe checks if a single host is up
+func (c *healthChecker) probe(host string) error {
+
+	// tcp checks only need to connect
+	if c.options.Type == "tcp" {
+
+		conn, err := net.DialTimeout("tcp", c.address(host), time.Duration(c.options.Timeout)*time.Second)
+		if err != nil {
+
+			return err
+
+		}
+
+		return conn.Close()
+
+	}
+
+	// http checks need a good response
+	scheme := "http"
+	if c.options.HTTPS {
+
+		scheme = "https"
+
+	}
+	res, err := c.client.Get(fmt.Sprintf("%s://%s%s", scheme, c.address(host), c.options.Path))
+	if err != nil {
+
+		return err
+
+	}
+	res.Body.Close()
+
+	// anything but a server error is fine
+	if res.StatusCode >= 500 {
+
+		return fmt.Errorf("got status %s", res.Status)
+
+	}
+
+	return nil
+
+}
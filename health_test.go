@@ -0,0 +1,70 @@
+/*
+
+discovery/health_test.go
+
+tests for keeping track of which hosts are up
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestRecordFailuresAndRecovery(t *testing.T) {
+
+	// the log isn't needed
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+
+	// a host that is down after three failed checks in a row
+	groups := map[string]endpointSet{"default": testEndpointSet("default", "")}
+	checker := newHealthChecker(healthCheckOptions{Failures: 3}, groups)
+	down := errors.New("connection refused")
+
+	for i, test := range []struct {
+		err      error
+		healthy  bool
+		failures int
+	}{
+		// it starts out up, and a success in between starts the count over
+		{down, true, 1},
+		{down, true, 2},
+		{nil, true, 0},
+		{down, true, 1},
+		{down, true, 2},
+
+		// then it's down once the threshold is reached, and stays down
+		{down, false, 3},
+		{down, false, 4},
+
+		// until a single check passes again
+		{nil, true, 0},
+	} {
+
+		checker.record("default.api", test.err)
+		state := checker.hosts["default.api"]
+		if checker.healthy("default.api") != test.healthy || state.Failures != test.failures || (test.err == nil) != (state.LastError == "") {
+
+			t.Errorf("check %d: expected healthy to be %v after %d failures, got %+v", i, test.healthy, test.failures, *state)
+
+		}
+
+	}
+
+	// the other hosts aren't affected
+	if checker.healthy("default.wiiu") == false {
+
+		t.Error("expected the other hosts to still be healthy")
+
+	}
+
+}
@@ -0,0 +1,208 @@
+/*
+
+discovery/index.go
+
+normalization and lookups of servicetokens
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"errors"
+	"log"
+	"strings"
+	// externals
+	"gitlab.com/superwhiskers/libninty"
+)
+
+// replaces the characters of the url-safe base64 alphabet with the standard ones
+var base64Alphabet = strings.NewReplacer("-", "+", "_", "/")
+
+// normalizeServiceToken turns an X-Nintendo-Servicetoken header into the single form
+// that is used for logging, fingerprinting and matching the bans and the groupdefs,
+// so the same console always ends up with the same servicetoken
+func normalizeServiceToken(header string) (string, error) {
+
+	// remove the whitespace that proxies and copying and pasting tend to add
+	header = strings.TrimSpace(header)
+
+	// check that there is one
+	if header == "" {
+
+		return "", errors.New("no servicetoken was sent")
+
+	}
+
+	// accept the url-safe base64 alphabet and missing padding too
+	header = base64Alphabet.Replace(header)
+	if remainder := len(header) % 4; remainder != 0 {
+
+		header += strings.Repeat("=", 4-remainder)
+
+	}
+
+	// decode it
+	token, err := libninty.DecodeServiceToken(header)
+	if err != nil {
+
+		return "", err
+
+	}
+
+	// remove any padding left at the end
+	return strings.TrimRight(token, "\x00"), nil
+
+}
+
+// tokenIndex speeds up finding which key of the bans or the groupdefs
+// matches a servicetoken. keys that are fingerprints are found with a
+// single map lookup, while legacy bcrypt keys still have to be compared
+// one by one
+type tokenIndex struct {
+	name         string
+	fingerprints map[string]string
+	legacy       []string
+}
+
+// newTokenIndex sorts the keys of the bans or the groupdefs into an index
+func newTokenIndex(name string, keys []string) *tokenIndex {
+
+	// the index
+	index := &tokenIndex{
+		name:         name,
+		fingerprints: map[string]string{},
+		legacy:       []string{},
+	}
+
+	// sort each key
+	for _, key := range keys {
+
+		// check if it's a fingerprint
+		if isFingerprint(key) {
+
+			// fingerprints are hexadecimal, so the case doesn't matter
+			index.fingerprints[strings.ToLower(key)] = key
+			continue
+
+		}
+
+		// otherwise, it has to be a bcrypt hash
+		if !isHash(key) {
+
+			// show the error
+			log.Printf("[err]: %s key %s is not a hexadecimal-encoded hash, ignoring it...\n", name, key)
+			continue
+
+		}
+
+		index.legacy = append(index.legacy, key)
+
+	}
+
+	// let the user know that fingerprints won't match if there's no secret
+	if len(index.fingerprints) != 0 && fingerprintSecret == "" {
+
+		log.Printf("[err]: %s contains fingerprints, but options.fingerprintSecret is not set...\n", name)
+
+	}
+
+	return index
+
+}
+
+// lookup returns the key that matches the servicetoken, checking the fingerprint
+// first and falling back to comparing each of the candidate forms of the servicetoken
+// against every legacy key
+func (i *tokenIndex) lookup(tokenFingerprint string, candidates []string) (string, bool) {
+
+	return i.lookupWhere(tokenFingerprint, candidates, nil)
+
+}
+
+// lookupWhere is lookup, but it skips the keys that accept refuses, so an entry that
+// doesn't count anymore (like a ban that has run out) can't hide one that still does
+func (i *tokenIndex) lookupWhere(tokenFingerprint string, candidates []string, accept func(key string) bool) (string, bool) {
+
+	// try the fingerprint
+	if tokenFingerprint != "" {
+
+		if key, ok := i.fingerprints[tokenFingerprint]; ok && (accept == nil || accept(key)) {
+
+			return key, true
+
+		}
+
+	}
+
+	// then go over the legacy keys
+	for _, key := range i.legacy {
+
+		// skip the ones that don't count
+		if accept != nil && !accept(key) {
+
+			continue
+
+		}
+
+		// check if any form of the servicetoken matches
+		for _, candidate := range candidates {
+
+			if match, _ := compareHash(candidate, key); match == true {
+
+				// point out what the entry can be migrated to
+				if tokenFingerprint != "" {
+
+					log.Printf("-> %s key %s is a legacy hash, it can be replaced with %s\n", i.name, key, tokenFingerprint)
+
+				}
+
+				return key, true
+
+			}
+
+		}
+
+	}
+
+	return "", false
+
+}
+
+// the keys of the banlist
+func banKeys(bans map[string]ban) []string {
+
+	// the keys
+	keys := make([]string, 0, len(bans))
+
+	// collect them
+	for key := range bans {
+
+		keys = append(keys, key)
+
+	}
+
+	return keys
+
+}
+
+// the keys of the groupdefs
+func groupdefKeys(groupdefs map[string]string) []string {
+
+	// the keys
+	keys := make([]string, 0, len(groupdefs))
+
+	// collect them
+	for key := range groupdefs {
+
+		keys = append(keys, key)
+
+	}
+
+	return keys
+
+}
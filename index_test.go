@@ -0,0 +1,64 @@
+/*
+
+discovery/index_test.go
+
+tests for looking servicetokens up in the bans and the groupdefs
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"testing"
+	"time"
+	// externals
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLookupSkipsExpiredBans(t *testing.T) {
+
+	// a temporary ban on the fingerprint that has run out, and a permanent legacy ban
+	token := "servicetoken"
+	tokenFingerprint := fingerprint(token, "a-secret-that-is-long-enough")
+	legacy, err := hash(token, bcrypt.MinCost)
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+	expired := time.Now().Add(-time.Hour)
+	bans := map[string]ban{
+		tokenFingerprint: {Reason: "temporary", Expires: &expired},
+		legacy:           {Reason: "permanent"},
+	}
+	index := newTokenIndex("bans", banKeys(bans))
+	active := func(key string) bool { return !bans[key].expired(time.Now()) }
+
+	// the permanent ban still applies
+	key, banned := index.lookupWhere(tokenFingerprint, []string{token}, active)
+	if !banned || bans[key].Reason != "permanent" {
+
+		t.Fatalf("expected the permanent ban, got %q (banned: %t)", key, banned)
+
+	}
+
+	// and once it runs out too, they aren't banned at all
+	bans[legacy] = ban{Reason: "permanent", Expires: &expired}
+	if key, banned := index.lookupWhere(tokenFingerprint, []string{token}, active); banned {
+
+		t.Fatalf("expected no ban, got %q", key)
+
+	}
+
+	// a plain lookup still finds the first match
+	if key, ok := index.lookup(tokenFingerprint, []string{token}); !ok || key != tokenFingerprint {
+
+		t.Fatalf("expected the fingerprint, got %q (found: %t)", key, ok)
+
+	}
+
+}
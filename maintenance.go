@@ -0,0 +1,319 @@
+/*
+
+discovery/maintenance.go
+
+working out whether a console is affected by maintenance
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// the message sent to consoles during maintenance, unless another one is configured
+const defaultMaintenanceMessage = "SERVICE_MAINTENANCE"
+
+// maintenanceStatus is the maintenance status, which either covers everyone or
+// only the consoles that fall into one of its scopes, along with any scheduled windows
+type maintenanceStatus struct {
+	InMaintenance bool
+	Message       string
+	Scopes        []maintenanceScope
+	Windows       []maintenanceWindow
+}
+
+// maintenanceScope puts only some consoles in maintenance: the ones sent to a group,
+// the ones whose parampack matches, or the ones that satisfy both
+type maintenanceScope struct {
+	parampackRule
+	Group   string
+	Message string
+}
+
+// the maintenance status, as it is sent by a url
+type maintenanceJSON struct {
+	InMaintenance *bool                   `json:"inMaintenance"`
+	Message       string                  `json:"message"`
+	Scopes        []maintenanceScopeJSON  `json:"scopes"`
+	Windows       []maintenanceWindowJSON `json:"windows"`
+}
+
+// a maintenance scope, as it is sent by a url
+type maintenanceScopeJSON struct {
+	Group   string                 `json:"group"`
+	Match   map[string]interface{} `json:"match"`
+	Except  map[string]interface{} `json:"except"`
+	Message string                 `json:"message"`
+}
+
+// messageOr returns a message, or the fallback if it's empty
+func messageOr(message, fallback string) string {
+
+	if message == "" {
+
+		return fallback
+
+	}
+
+	return message
+
+}
+
+// scoped checks if a scope only covers some consoles
+func (s maintenanceScope) scoped() bool {
+
+	return s.Group != "" || len(s.Match) != 0 || len(s.Except) != 0
+
+}
+
+// covers checks if a console sent to a group falls into the scope
+func (s maintenanceScope) covers(group string, fields map[string]string) bool {
+
+	// it has to be the right group, if the scope has one
+	if s.Group != "" && s.Group != group {
+
+		return false
+
+	}
+
+	// and the right parampack, if the scope has any rules for it
+	return (len(s.Match) == 0 && len(s.Except) == 0) || s.matches(fields)
+
+}
+
+// global checks if everyone is in maintenance, either because it's turned on or because
+// a window that covers everyone is in progress, returning the message to show them
+func (m maintenanceStatus) global(now time.Time) (string, bool) {
+
+	// check if it's turned on
+	if m.InMaintenance {
+
+		return messageOr(m.Message, defaultMaintenanceMessage), true
+
+	}
+
+	// check the windows that cover everyone
+	for _, window := range m.Windows {
+
+		if _, _, ok := window.current(now); ok && !window.scoped() {
+
+			return messageOr(window.Message, messageOr(m.Message, defaultMaintenanceMessage)), true
+
+		}
+
+	}
+
+	return "", false
+
+}
+
+// scoped checks if a console sent to a group falls into one of the scopes, or into a
+// scoped window that is in progress, returning the message to show it
+func (m maintenanceStatus) scoped(group string, fields map[string]string, now time.Time) (string, bool) {
+
+	// check each scope
+	for _, scope := range m.Scopes {
+
+		if scope.covers(group, fields) {
+
+			return messageOr(scope.Message, messageOr(m.Message, defaultMaintenanceMessage)), true
+
+		}
+
+	}
+
+	// check each scoped window
+	for _, window := range m.Windows {
+
+		if !window.scoped() || !window.covers(group, fields) {
+
+			continue
+
+		}
+
+		if _, _, ok := window.current(now); ok {
+
+			return messageOr(window.Message, messageOr(m.Message, defaultMaintenanceMessage)), true
+
+		}
+
+	}
+
+	return "", false
+
+}
+
+// parseMaintenance parses the maintenance status sent by a url. it can either be the
+// plain { "inMaintenance": false }, or have a message, scopes and windows too
+func parseMaintenance(data []byte, groups map[string]endpointSet) (maintenanceStatus, error) {
+
+	// the parsed status
+	var tmp maintenanceJSON
+
+	// numbers are kept as they are, since title ids are too big for a float
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&tmp); err != nil {
+
+		return maintenanceStatus{}, err
+
+	}
+
+	// it has to say something
+	if tmp.InMaintenance == nil && tmp.Scopes == nil && tmp.Windows == nil {
+
+		return maintenanceStatus{}, errors.New("inMaintenance is missing")
+
+	}
+
+	// convert it
+	status := maintenanceStatus{Message: tmp.Message, Scopes: []maintenanceScope{}, Windows: []maintenanceWindow{}}
+	if tmp.InMaintenance != nil {
+
+		status.InMaintenance = *tmp.InMaintenance
+
+	}
+	for i, scope := range tmp.Scopes {
+
+		// convert the scope
+		converted, err := maintenanceScopeFromJSON(scope, groups)
+		if err != nil {
+
+			return maintenanceStatus{}, fmt.Errorf("scope %d: %v", i, err)
+
+		}
+
+		// a scope that matches everything would be the same as inMaintenance
+		if !converted.scoped() {
+
+			return maintenanceStatus{}, fmt.Errorf("scope %d: needs a group, match or except", i)
+
+		}
+
+		status.Scopes = append(status.Scopes, converted)
+
+	}
+	for i, window := range tmp.Windows {
+
+		// convert the scope, which windows don't need to have
+		scope, err := maintenanceScopeFromJSON(window.maintenanceScopeJSON, groups)
+		if err != nil {
+
+			return maintenanceStatus{}, fmt.Errorf("window %d: %v", i, err)
+
+		}
+
+		// convert the window
+		converted, err := newMaintenanceWindow(scope, window.Start, window.End, window.Cron, window.Duration, window.Timezone)
+		if err != nil {
+
+			return maintenanceStatus{}, fmt.Errorf("window %d: %v", i, err)
+
+		}
+
+		status.Windows = append(status.Windows, converted)
+
+	}
+
+	return status, nil
+
+}
+
+// maintenanceScopeFromJSON converts a scope sent by a url
+func maintenanceScopeFromJSON(scope maintenanceScopeJSON, groups map[string]endpointSet) (maintenanceScope, error) {
+
+	// the converted scope
+	converted := maintenanceScope{Group: scope.Group, Message: scope.Message}
+
+	// the group has to exist
+	if _, ok := groups[scope.Group]; scope.Group != "" && !ok {
+
+		return maintenanceScope{}, fmt.Errorf("unknown endpoints group %q", scope.Group)
+
+	}
+
+	// convert the rules
+	var err error
+	if converted.Match, err = parampackMatcherFromJSON(scope.Match); err != nil {
+
+		return maintenanceScope{}, fmt.Errorf("match: %v", err)
+
+	}
+	if converted.Except, err = parampackMatcherFromJSON(scope.Except); err != nil {
+
+		return maintenanceScope{}, fmt.Errorf("except: %v", err)
+
+	}
+
+	return converted, nil
+
+}
+
+// parampackMatcherFromJSON converts a map of parampack fields to either a value or a list of
+// values, as decoded from json, into a matcher
+func parampackMatcherFromJSON(fields map[string]interface{}) (parampackMatcher, error) {
+
+	// the converted matcher
+	matcher := parampackMatcher{}
+
+	// convert each field
+	for field, value := range fields {
+
+		// make sure parampacks have it
+		if !isParampackField(field) {
+
+			return nil, fmt.Errorf("unknown parampack field %q (expected one of %s)", field, strings.Join(parampackFields, ", "))
+
+		}
+
+		// a single value is the same as a list of one
+		values, ok := value.([]interface{})
+		if !ok {
+
+			values = []interface{}{value}
+
+		}
+
+		// convert each value
+		for _, expected := range values {
+
+			var written string
+			switch expected := expected.(type) {
+
+			case string:
+				written = expected
+
+			case json.Number:
+				written = expected.String()
+
+			default:
+				return nil, fmt.Errorf("%s: expected a string or a number", field)
+
+			}
+
+			normalized, err := parseParampackValue(field, written)
+			if err != nil {
+
+				return nil, fmt.Errorf("%s: %v", field, err)
+
+			}
+			matcher[field] = append(matcher[field], normalized)
+
+		}
+
+	}
+
+	return matcher, nil
+
+}
@@ -0,0 +1,111 @@
+/*
+
+discovery/maintenance_test.go
+
+tests for parsing the maintenance status sent by a url
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMaintenance(t *testing.T) {
+
+	// the groups the scopes can point at, and the consoles that are checked
+	groups := map[string]endpointSet{"default": {}, "other": {}}
+	wiiu, n3ds := map[string]string{"platform_id": "1"}, map[string]string{"platform_id": "0"}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		name, data string
+
+		// what everyone, a wii u in each group and a 3ds in the default group are told,
+		// with "" meaning they aren't in maintenance
+		global, wiiuDefault, wiiuOther, n3dsDefault string
+	}{
+		{"the old shape, turned off", `{"inMaintenance": false}`, "", "", "", ""},
+		{"the old shape, turned on", `{"inMaintenance": true}`, "SERVICE_MAINTENANCE", "", "", ""},
+		{"a message", `{"inMaintenance": true, "message": "back soon"}`, "back soon", "", "", ""},
+		{"a scope on a group", `{"scopes": [{"group": "other", "message": "other is down"}]}`, "", "", "other is down", ""},
+		{"a scope on a platform", `{"message": "no 3ds", "scopes": [{"match": {"platform_id": "3ds"}}]}`, "", "", "", "no 3ds"},
+		{"a scope on everything but a platform", `{"scopes": [{"except": {"platform_id": "wiiu"}}]}`, "", "", "", "SERVICE_MAINTENANCE"},
+		{"a scope on a group and a platform", `{"inMaintenance": false, "scopes": [{"group": "default", "match": {"platform_id": 1}}]}`, "", "SERVICE_MAINTENANCE", "", ""},
+		{"a window in progress", `{"windows": [{"start": "2024-01-01T11:00:00Z", "end": "2024-01-01T13:00:00Z", "message": "upgrading"}]}`, "upgrading", "", "", ""},
+		{"a scoped window in progress", `{"windows": [{"group": "other", "start": "2024-01-01T11:00:00Z", "end": "2024-01-01T13:00:00Z"}]}`, "", "", "SERVICE_MAINTENANCE", ""},
+		{"a window that is over", `{"windows": [{"start": "2024-01-01T10:00:00Z", "end": "2024-01-01T11:00:00Z"}]}`, "", "", "", ""},
+	} {
+
+		status, err := parseMaintenance([]byte(test.data), groups)
+		if err != nil {
+
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+
+		}
+
+		// check what everyone is told
+		if message, _ := status.global(now); message != test.global {
+
+			t.Errorf("%s: expected everyone to be told %q, got %q", test.name, test.global, message)
+
+		}
+
+		// and what each console is told
+		for _, console := range []struct {
+			group    string
+			fields   map[string]string
+			expected string
+		}{
+			{"default", wiiu, test.wiiuDefault},
+			{"other", wiiu, test.wiiuOther},
+			{"default", n3ds, test.n3dsDefault},
+		} {
+
+			if message, _ := status.scoped(console.group, console.fields, now); message != console.expected {
+
+				t.Errorf("%s: expected a console in %s with %v to be told %q, got %q", test.name, console.group, console.fields, console.expected, message)
+
+			}
+
+		}
+
+	}
+
+}
+
+func TestParseMaintenanceProblems(t *testing.T) {
+
+	groups := map[string]endpointSet{"default": {}}
+
+	for _, test := range []struct {
+		name, data, problem string
+	}{
+		{"invalid json", `{"inMaintenance": fals`, "unexpected"},
+		{"nothing at all", `{}`, "inMaintenance is missing"},
+		{"a message alone", `{"message": "back soon"}`, "inMaintenance is missing"},
+		{"a scope on an unknown group", `{"scopes": [{"group": "nowhere"}]}`, `scope 0: unknown endpoints group "nowhere"`},
+		{"a window on an unknown group", `{"windows": [{"group": "nowhere", "start": "2024-01-01T11:00:00Z", "end": "2024-01-01T13:00:00Z"}]}`, `window 0: unknown endpoints group "nowhere"`},
+		{"a scope on everything", `{"scopes": [{"group": "default"}, {}]}`, "scope 1: needs a group, match or except"},
+		{"a scope on an unknown field", `{"scopes": [{"match": {"title": 1}}]}`, "scope 0: match"},
+	} {
+
+		// it has to be refused, saying why
+		_, err := parseMaintenance([]byte(test.data), groups)
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.problem, err)
+
+		}
+
+	}
+
+}
@@ -0,0 +1,250 @@
+/*
+
+discovery/parampack.go
+
+unpacking parampacks and matching rules against them
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"fmt"
+	"strconv"
+	"strings"
+	// externals
+	"gitlab.com/superwhiskers/libninty"
+)
+
+// the fields that a parampack can contain
+var parampackFields = []string{
+	"title_id",
+	"access_key",
+	"platform_id",
+	"region_id",
+	"language_id",
+	"country_id",
+	"area_id",
+	"network_restriction",
+	"friend_restriction",
+	"rating_restriction",
+	"rating_organization",
+	"transferable_id",
+	"tz_name",
+	"utc_offset",
+	"remaster_version",
+}
+
+// the fields that are numbers, and can be written in decimal or as 0x-prefixed hexadecimal
+var parampackNumbers = map[string]bool{
+	"title_id":        true,
+	"transferable_id": true,
+	"platform_id":     true,
+	"region_id":       true,
+	"language_id":     true,
+	"country_id":      true,
+}
+
+// friendlier names for the values of some of the fields
+var parampackAliases = map[string]map[string]string{
+	"platform_id": {
+		"3ds":  "0",
+		"wiiu": "1",
+	},
+	"region_id": {
+		"jpn": "1",
+		"usa": "2",
+		"eur": "4",
+		"aus": "8",
+		"chn": "16",
+		"kor": "32",
+		"twn": "64",
+	},
+	"language_id": {
+		"ja":    "0",
+		"en":    "1",
+		"fr":    "2",
+		"de":    "3",
+		"it":    "4",
+		"es":    "5",
+		"zh":    "6",
+		"ko":    "7",
+		"nl":    "8",
+		"pt":    "9",
+		"ru":    "10",
+		"zh-tw": "11",
+	},
+}
+
+// parampackMatcher matches a parampack when every one of its fields has one of the listed values
+type parampackMatcher map[string][]string
+
+// parampackRule matches parampacks that match Match, but not Except
+type parampackRule struct {
+	Match  parampackMatcher
+	Except parampackMatcher
+}
+
+// denyRule refuses requests whose parampack matches it
+type denyRule struct {
+	parampackRule
+	Code      int
+	ErrorCode int
+	Message   string
+}
+
+// route sends requests whose parampack matches it to an endpoints group
+type route struct {
+	parampackRule
+	Group string
+}
+
+// isParampackField checks if a field is one that parampacks contain
+func isParampackField(field string) bool {
+
+	for _, name := range parampackFields {
+
+		if name == field {
+
+			return true
+
+		}
+
+	}
+
+	return false
+
+}
+
+// normalizeParampackValue turns a value of a field into the form that is compared,
+// so aliases, hexadecimal and leading zeroes all match what the console sends
+func normalizeParampackValue(field, value string) string {
+
+	// values that can't be parsed are compared as they are
+	normalized, _ := parseParampackValue(field, value)
+	return normalized
+
+}
+
+// parseParampackValue normalizes a value of a field, returning an error if it's a
+// number that can't be parsed. numbers are decimal unless they have a 0x prefix, so
+// leading zeroes don't make them octal
+func parseParampackValue(field, value string) (string, error) {
+
+	// values are compared without surrounding whitespace or case
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	// replace aliases
+	if alias, ok := parampackAliases[field][value]; ok {
+
+		value = alias
+
+	}
+
+	// only numbers have to be written the same way
+	if !parampackNumbers[field] {
+
+		return value, nil
+
+	}
+
+	// parse it in the base it was written in
+	digits, base := value, 10
+	if strings.HasPrefix(value, "0x") {
+
+		digits, base = value[2:], 16
+
+	}
+	number, err := strconv.ParseUint(digits, base, 64)
+	if err != nil {
+
+		return value, fmt.Errorf("%q isn't a number (expected decimal, or hexadecimal with a 0x prefix)", value)
+
+	}
+
+	return strconv.FormatUint(number, 10), nil
+
+}
+
+// parampackFieldsFrom normalizes the fields of a decoded parampack, so the rules can
+// match them
+func parampackFieldsFrom(parampack libninty.Parampack) map[string]string {
+
+	// the fields
+	fields := make(map[string]string, len(parampack))
+	for field, value := range parampack {
+
+		fields[field] = normalizeParampackValue(field, value)
+
+	}
+
+	return fields
+
+}
+
+// matches checks if a parampack matches. a matcher with no fields matches everything
+func (m parampackMatcher) matches(fields map[string]string) bool {
+
+	// every field has to match
+	for field, values := range m {
+
+		// the value the console sent
+		value, ok := fields[field]
+		if !ok {
+
+			return false
+
+		}
+
+		// it has to be one of the listed ones
+		found := false
+		for _, expected := range values {
+
+			if value == expected {
+
+				found = true
+				break
+
+			}
+
+		}
+
+		if !found {
+
+			return false
+
+		}
+
+	}
+
+	return true
+
+}
+
+// matches checks if a rule applies to a parampack
+func (r parampackRule) matches(fields map[string]string) bool {
+
+	return r.Match.matches(fields) && (len(r.Except) == 0 || !r.Except.matches(fields))
+
+}
+
+// matchRoutes returns the group of the first route that matches a parampack
+func matchRoutes(routes []route, fields map[string]string) (string, bool) {
+
+	for _, candidate := range routes {
+
+		if candidate.matches(fields) {
+
+			return candidate.Group, true
+
+		}
+
+	}
+
+	return "", false
+
+}
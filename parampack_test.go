@@ -0,0 +1,79 @@
+/*
+
+discovery/parampack_test.go
+
+tests for normalizing parampack values
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"testing"
+)
+
+func TestParseParampackValue(t *testing.T) {
+
+	for _, test := range []struct {
+		field, value, expected string
+		fails                  bool
+	}{
+		{"title_id", "1407375153041408", "1407375153041408", false},
+		{"title_id", "0x0005000010101000", "1407375153041408", false},
+		{"title_id", "0X0005000010101000", "1407375153041408", false},
+		{"region_id", "010", "10", false},
+		{"region_id", " usa ", "2", false},
+		{"platform_id", "WiiU", "1", false},
+		{"title_id", "0005000010101a00", "", true},
+		{"title_id", "0xnope", "", true},
+		{"title_id", "-1", "", true},
+		{"tz_name", "America/New_York", "america/new_york", false},
+		{"utc_offset", "0x10", "0x10", false},
+	} {
+
+		normalized, err := parseParampackValue(test.field, test.value)
+		if test.fails == true {
+
+			if err == nil {
+
+				t.Errorf("%s: %q: expected an error, got %q", test.field, test.value, normalized)
+
+			}
+			continue
+
+		}
+		if err != nil || normalized != test.expected {
+
+			t.Errorf("%s: %q: expected %q, got %q (error: %v)", test.field, test.value, test.expected, normalized, err)
+
+		}
+
+	}
+
+}
+
+func TestParampackMatcherFromJSONRejectsBadNumbers(t *testing.T) {
+
+	if _, err := parampackMatcherFromJSON(map[string]interface{}{"title_id": []interface{}{"0x0005000010101000", "not a number"}}); err == nil {
+
+		t.Fatal("expected an error for a title id that isn't a number")
+
+	}
+
+	matcher, err := parampackMatcherFromJSON(map[string]interface{}{"title_id": "0x0005000010101000"})
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+	if !matcher.matches(map[string]string{"title_id": normalizeParampackValue("title_id", "1407375153041408")}) {
+
+		t.Fatal("expected the hexadecimal title id to match the decimal one the console sends")
+
+	}
+
+}
@@ -0,0 +1,359 @@
+/*
+
+discovery/proxy.go
+
+figuring out the address of the client when running behind
+reverse proxies and load balancers
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the signature that starts a version 2 proxy protocol header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// how long a trusted proxy has to send the proxy protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+// isTrusted checks if an address belongs to one of the networks
+func isTrusted(networks []*net.IPNet, ip net.IP) bool {
+
+	// check each network
+	for _, network := range networks {
+
+		if network.Contains(ip) {
+
+			return true
+
+		}
+
+	}
+
+	return false
+
+}
+
+// hostIP gets the ip out of an address that may have a port on it
+func hostIP(address string) net.IP {
+
+	// remove the port
+	if host, _, err := net.SplitHostPort(address); err == nil {
+
+		address = host
+
+	}
+
+	return net.ParseIP(address)
+
+}
+
+// clientIP returns the address a request came from. the X-Forwarded-For and
+// X-Real-IP headers are only believed when the request came from a trusted proxy,
+// since anyone else could put whatever they want in them
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+
+	// the peer that connected to us
+	peer := hostIP(r.RemoteAddr)
+	if peer == nil {
+
+		return r.RemoteAddr
+
+	}
+
+	// if it isn't a proxy we trust, it's the client
+	if !isTrusted(trusted, peer) {
+
+		return peer.String()
+
+	}
+
+	// otherwise, go backwards through the proxies that forwarded it until
+	// we reach one that we don't trust, which is the client
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+
+		// parse the address
+		ip := hostIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+
+			break
+
+		}
+
+		// check if this is another proxy
+		if !isTrusted(trusted, ip) {
+
+			return ip.String()
+
+		}
+
+		peer = ip
+
+	}
+
+	// fall back to the header some proxies use instead
+	if ip := hostIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+
+		return ip.String()
+
+	}
+
+	return peer.String()
+
+}
+
+// proxyListener accepts connections that may start with a proxy protocol
+// (version 1 or 2) header, which is only read if the connection comes from
+// a trusted proxy
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// Accept waits for the next connection
+func (l *proxyListener) Accept() (net.Conn, error) {
+
+	// get the connection
+	conn, err := l.Listener.Accept()
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	return &proxyConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		trusted: l.trusted,
+	}, nil
+
+}
+
+// proxyConn is a connection that reads its proxy protocol header the first time
+// it's used, so a slow client can't hold up accepting other connections
+type proxyConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	trusted []*net.IPNet
+	once    sync.Once
+	remote  net.Addr
+	err     error
+}
+
+// readHeader reads the proxy protocol header if the connection is from a trusted proxy
+func (c *proxyConn) readHeader() {
+
+	c.once.Do(func() {
+
+		// it's the peer unless the header says otherwise
+		c.remote = c.Conn.RemoteAddr()
+
+		// only trusted proxies can say otherwise
+		if !isTrusted(c.trusted, hostIP(c.remote.String())) {
+
+			return
+
+		}
+
+		// read the header
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		remote, err := readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+
+		// check for errors
+		if err != nil {
+
+			c.err = fmt.Errorf("invalid proxy protocol header from %s: %v", c.remote, err)
+			return
+
+		}
+
+		// use the address from the header if it had one
+		if remote != nil {
+
+			c.remote = remote
+
+		}
+
+	})
+
+}
+
+// Read reads data from the connection, after the proxy protocol header
+func (c *proxyConn) Read(b []byte) (int, error) {
+
+	// make sure the header has been read
+	c.readHeader()
+	if c.err != nil {
+
+		return 0, c.err
+
+	}
+
+	return c.reader.Read(b)
+
+}
+
+// RemoteAddr returns the address of the client, as told by the proxy
+func (c *proxyConn) RemoteAddr() net.Addr {
+
+	// make sure the header has been read
+	c.readHeader()
+
+	return c.remote
+
+}
+
+// readProxyHeader reads a version 1 or 2 proxy protocol header. it returns no address if there
+// is no header, or if the header doesn't carry one (like health checks from the proxy itself)
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+
+	// check which version it is
+	if start, err := reader.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(start, proxyV2Signature) {
+
+		return readProxyV2Header(reader)
+
+	}
+	if start, err := reader.Peek(6); err == nil && string(start) == "PROXY " {
+
+		return readProxyV1Header(reader)
+
+	}
+
+	// there isn't one
+	return nil, nil
+
+}
+
+// readProxyV1Header reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func readProxyV1Header(reader *bufio.Reader) (net.Addr, error) {
+
+	// the header is at most 107 bytes long, including the line ending
+	line := make([]byte, 0, 107)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+
+		// make sure it isn't too long
+		if len(line) == cap(line) {
+
+			return nil, errors.New("version 1 header is too long")
+
+		}
+
+		// read the next byte
+		b, err := reader.ReadByte()
+		if err != nil {
+
+			return nil, err
+
+		}
+		line = append(line, b)
+
+	}
+
+	// split it up
+	parts := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+
+	// the proxy doesn't know who the client is
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+
+		return nil, nil
+
+	}
+
+	// otherwise, there are always six parts
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+
+		return nil, fmt.Errorf("malformed version 1 header %q", line)
+
+	}
+
+	// parse the source address
+	ip := net.ParseIP(parts[2])
+	port, err := strconv.Atoi(parts[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+
+		return nil, fmt.Errorf("malformed version 1 header %q", line)
+
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+
+}
+
+// readProxyV2Header reads the binary version of the header
+func readProxyV2Header(reader *bufio.Reader) (net.Addr, error) {
+
+	// the signature, version and command, address family and length
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+
+		return nil, err
+
+	}
+
+	// check the version
+	if header[12]>>4 != 2 {
+
+		return nil, fmt.Errorf("unsupported version %d", header[12]>>4)
+
+	}
+
+	// read the addresses, along with anything else the proxy put after them
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+
+		return nil, err
+
+	}
+
+	// connections the proxy made itself don't have a client
+	if header[12]&0x0f == 0 {
+
+		return nil, nil
+
+	}
+
+	// get the source address for tcp over ipv4 or ipv6
+	switch header[13] {
+
+	case 0x11:
+		if len(payload) < 12 {
+
+			return nil, errors.New("version 2 header is too short for ipv4 addresses")
+
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+
+	case 0x21:
+		if len(payload) < 36 {
+
+			return nil, errors.New("version 2 header is too short for ipv6 addresses")
+
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+
+	}
+
+	// anything else doesn't have an address we can use
+	return nil, nil
+
+}
@@ -0,0 +1,164 @@
+/*
+
+discovery/proxy_test.go
+
+tests for figuring out the address of the client behind proxies
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header builds a version 2 header with a command, an address family and a payload
+func proxyV2Header(version, command, family byte, payload []byte) string {
+
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, version<<4|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(payload)))
+	return string(append(header, payload...))
+
+}
+
+func TestReadProxyHeader(t *testing.T) {
+
+	// the payloads of the version 2 headers
+	ipv4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	copy(ipv6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(ipv6[32:], 56324)
+	withExtras := append(append([]byte{}, ipv4...), 0x04, 0x00, 0x01, 0x00)
+
+	for _, test := range []struct {
+		name, header, expected string
+		fails                  bool
+	}{
+		{"no header", "GET / HTTP/1.1\r\n", "", false},
+		{"v1, ipv4", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", "192.0.2.1:56324", false},
+		{"v1, ipv6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", false},
+		{"v1, unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1, wrong protocol", "PROXY UDP4 192.0.2.1 192.0.2.2 56324 443\r\n", "", true},
+		{"v1, missing parts", "PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n", "", true},
+		{"v1, bad address", "PROXY TCP4 192.0.2.x 192.0.2.2 56324 443\r\n", "", true},
+		{"v1, bad port", "PROXY TCP4 192.0.2.1 192.0.2.2 65536 443\r\n", "", true},
+		{"v1, too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", true},
+		{"v1, cut off", "PROXY TCP4 192.0.2.1", "", true},
+		{"v2, ipv4", proxyV2Header(2, 1, 0x11, ipv4), "192.0.2.1:56324", false},
+		{"v2, ipv6", proxyV2Header(2, 1, 0x21, ipv6), "[2001:db8::1]:56324", false},
+		{"v2, with tlvs", proxyV2Header(2, 1, 0x11, withExtras), "192.0.2.1:56324", false},
+		{"v2, local", proxyV2Header(2, 0, 0x11, ipv4), "", false},
+		{"v2, unspecified family", proxyV2Header(2, 1, 0x00, nil), "", false},
+		{"v2, wrong version", proxyV2Header(1, 1, 0x11, ipv4), "", true},
+		{"v2, ipv4 too short", proxyV2Header(2, 1, 0x11, ipv4[:8]), "", true},
+		{"v2, ipv6 too short", proxyV2Header(2, 1, 0x21, ipv4), "", true},
+		{"v2, cut off", proxyV2Header(2, 1, 0x11, ipv4)[:20], "", true},
+	} {
+
+		address, err := readProxyHeader(bufio.NewReader(strings.NewReader(test.header)))
+		if test.fails == true {
+
+			if err == nil {
+
+				t.Errorf("%s: expected an error, got %v", test.name, address)
+
+			}
+			continue
+
+		}
+		if err != nil {
+
+			t.Errorf("%s: %v", test.name, err)
+			continue
+
+		}
+		if (address == nil && test.expected != "") || (address != nil && address.String() != test.expected) {
+
+			t.Errorf("%s: expected %q, got %v", test.name, test.expected, address)
+
+		}
+
+	}
+
+}
+
+func TestReadProxyHeaderLeavesTheRest(t *testing.T) {
+
+	// the request after the header is still there to be read
+	reader := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nGET / HTTP/1.1\r\n"))
+	if _, err := readProxyHeader(reader); err != nil {
+
+		t.Fatal(err)
+
+	}
+	rest, err := io.ReadAll(reader)
+	if err != nil || string(rest) != "GET / HTTP/1.1\r\n" {
+
+		t.Fatalf("expected the request to be left, got %q (error: %v)", rest, err)
+
+	}
+
+}
+
+func TestClientIP(t *testing.T) {
+
+	// the proxies we trust
+	trusted := []*net.IPNet{}
+	for _, network := range []string{"127.0.0.1", "10.0.0.0/8"} {
+
+		parsed, err := parseNetwork(network)
+		if err != nil {
+
+			t.Fatal(err)
+
+		}
+		trusted = append(trusted, parsed)
+
+	}
+
+	for _, test := range []struct {
+		name, remote, forwarded, realIP, expected string
+	}{
+		{"a client", "203.0.113.5:1234", "", "", "203.0.113.5"},
+		{"a client faking the headers", "203.0.113.5:1234", "198.51.100.1", "198.51.100.2", "203.0.113.5"},
+		{"through a proxy", "127.0.0.1:1234", "203.0.113.5", "", "203.0.113.5"},
+		{"through several proxies", "127.0.0.1:1234", "203.0.113.5, 10.0.0.2", "", "203.0.113.5"},
+		{"a faked address before the client", "127.0.0.1:1234", "198.51.100.1, 203.0.113.5", "", "203.0.113.5"},
+		{"only proxies", "127.0.0.1:1234", "10.0.0.2", "", "10.0.0.2"},
+		{"x-real-ip", "127.0.0.1:1234", "", "203.0.113.5", "203.0.113.5"},
+		{"no headers", "127.0.0.1:1234", "", "", "127.0.0.1"},
+		{"ipv6", "[2001:db8::1]:1234", "", "", "2001:db8::1"},
+	} {
+
+		r := &http.Request{RemoteAddr: test.remote, Header: http.Header{}}
+		if test.forwarded != "" {
+
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+
+		}
+		if test.realIP != "" {
+
+			r.Header.Set("X-Real-IP", test.realIP)
+
+		}
+		if ip := clientIP(r, trusted); ip != test.expected {
+
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, ip)
+
+		}
+
+	}
+
+}
@@ -0,0 +1,431 @@
+/*
+
+discovery/reload.go
+
+reloading the config while discovery is running, either on SIGHUP
+or whenever the file changes
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// the config discovery was started with. everything that is only read when it starts
+// (and where the data that isn't in the config comes from) is taken from this one
+var startConfig *configuration
+
+// reloadLock keeps reloads from happening at the same time
+var reloadLock sync.Mutex
+
+// restartSettings returns the things in the config that are only read when discovery
+// starts, by their path
+func restartSettings(config *configuration) map[string]interface{} {
+
+	return map[string]interface{}{
+		"options.https":                 config.Options.HTTPS,
+		"options.port":                  config.Options.Port,
+		"options.endpoint":              config.Options.Endpoint,
+		"options.logfile":               config.Options.Logfile,
+		"options.hashCost":              config.Options.HashCost,
+		"options.fingerprintSecret":     config.Options.FingerprintSecret,
+		"options.matchRawServicetokens": config.Options.MatchRawServicetokens,
+		"options.overrideDiscovery":     config.Options.OverrideDiscovery,
+		"options.trustedProxies":        config.Options.TrustedProxies,
+		"options.proxyProtocol":         config.Options.ProxyProtocol,
+		"options.healthCheck":           config.Options.HealthCheck,
+		"options.status":                config.Options.Status,
+		"options.webhook":               config.Options.Webhook,
+		"options.cache":                 config.Options.Cache,
+		"options.reloadOnChange":        config.Options.ReloadOnChange,
+		"options.maintenance":           sourceSettings(config.Options.Maintenance.remoteSource),
+		"options.bans":                  sourceSettings(config.Options.Bans.remoteSource),
+		"options.ipBans":                sourceSettings(config.Options.IPBans.remoteSource),
+		"groupdefs":                     sourceSettings(config.Groupdefs.remoteSource),
+		"rollouts":                      sourceSettings(config.Rollouts.remoteSource),
+	}
+
+}
+
+// sourceSettings returns the parts of a source that can be compared. the tls config
+// can't be, so only whether there is one is
+func sourceSettings(source remoteSource) interface{} {
+
+	hasTLS := source.TLS != nil
+	source.TLS = nil
+	return []interface{}{source, hasTLS}
+
+}
+
+// isRemote checks if a source is pulled from a url or read from a file, instead of
+// being written out in the config
+func isRemote(source remoteSource) bool {
+
+	return source.URL != "" || source.File != ""
+
+}
+
+// isInline checks if a source is written out in the config, both in the one discovery
+// was started with and in a reloaded one. where a source comes from can't change until
+// discovery is restarted, so the data in a reloaded config is only used if it is
+func isInline(started, reloaded remoteSource) bool {
+
+	return !isRemote(started) && !isRemote(reloaded)
+
+}
+
+// handleReloads reloads the config on SIGHUP, and whenever it changes if asked to
+func handleReloads(file string, onChange bool) {
+
+	// reload it on SIGHUP
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+
+		for range signals {
+
+			log.Printf("-> got SIGHUP, reloading %s...\n", file)
+			reloadConfig(file)
+
+		}
+
+	}()
+
+	// and when it changes
+	if onChange == true {
+
+		watchFile(file, func() {
+
+			log.Printf("-> %s changed, reloading it...\n", file)
+			reloadConfig(file)
+
+		})
+
+	}
+
+}
+
+// reloadConfig loads the config again and replaces the state with what it asks for. a
+// config with problems in it is refused, keeping the one we have
+func reloadConfig(file string) bool {
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	// load it
+	config, err := loadConfig(file)
+	if err != nil {
+
+		log.Printf("[err]: refusing to reload %s, keeping the config we have...\n", file)
+		reportConfigError(log.Writer(), file, err)
+		return false
+
+	}
+
+	// replace the state
+	var changes []string
+	var previous *healthChecker
+	err = updateState(func(next *discoveryState) error {
+
+		// build the new one
+		reloaded, err := reloadState(config, next)
+		if err != nil {
+
+			return err
+
+		}
+
+		// work out what changed
+		changes = describeChanges(next, reloaded)
+		if reloaded.health != next.health {
+
+			previous = next.health
+
+		}
+
+		*next = *reloaded
+		return nil
+
+	})
+	if err != nil {
+
+		log.Printf("[err]: refusing to reload %s, keeping the config we have...\n", file)
+		log.Printf("       error: %v\n", err)
+		return false
+
+	}
+
+	// the old health checker isn't used anymore
+	if previous != nil {
+
+		previous.stop()
+
+	}
+
+	// let the user know what changed
+	if len(changes) == 0 {
+
+		log.Printf("-> reloaded %s, nothing changed\n", file)
+
+	} else {
+
+		log.Printf("-> reloaded %s:\n", file)
+		for _, change := range changes {
+
+			log.Printf("   %s\n", change)
+
+		}
+
+	}
+
+	// and what didn't
+	_, _, changed := diffKeys(restartSettings(startConfig), restartSettings(config))
+	for _, path := range changed {
+
+		log.Printf("-> %s was changed, but discovery has to be restarted to use it\n", path)
+
+	}
+
+	return true
+
+}
+
+// reloadState creates the state that a reloaded config asks for. the data that is
+// pulled from a url or read from a file isn't in the config, so it's kept, and so is
+// the data of a source that was moved into or out of the config
+func reloadState(config *configuration, current *discoveryState) (*discoveryState, error) {
+
+	// the new state
+	next := newState(config)
+
+	// keep the data that isn't in the config
+	if !isInline(startConfig.Options.Maintenance.remoteSource, config.Options.Maintenance.remoteSource) {
+
+		next.maintenance = current.maintenance
+
+	}
+	if !isInline(startConfig.Options.Bans.remoteSource, config.Options.Bans.remoteSource) {
+
+		next.bans, next.banIndex = current.bans, current.banIndex
+
+	}
+	if !isInline(startConfig.Options.IPBans.remoteSource, config.Options.IPBans.remoteSource) {
+
+		next.ipBans = current.ipBans
+
+	}
+	if !isInline(startConfig.Groupdefs.remoteSource, config.Groupdefs.remoteSource) {
+
+		// groupdefs that point at groups that were removed are dropped
+		groupdefs := make(map[string]string, len(current.groupdefs))
+		for key, group := range current.groupdefs {
+
+			groupdefs[key] = group
+
+		}
+		checkGroupdefs(groupdefs, next.endpoints)
+		next.groupdefs, next.groupdefsIndex = groupdefs, current.groupdefsIndex
+		if len(groupdefs) != len(current.groupdefs) {
+
+			next.groupdefsIndex = newTokenIndex("groupdefs", groupdefKeys(groupdefs))
+
+		}
+
+	}
+	if !isInline(startConfig.Rollouts.remoteSource, config.Rollouts.remoteSource) {
+
+		// rollouts can't point at groups that were removed
+		for i, candidate := range current.rollouts {
+
+			if err := candidate.validate(next.endpoints); err != nil {
+
+				return nil, fmt.Errorf("rollout %d (which isn't in the config): %v", i, err)
+
+			}
+
+		}
+		next.rollouts = current.rollouts
+
+	}
+
+	// the hosts only have to be checked again if they changed
+	next.health = current.health
+	if startConfig.Options.HealthCheck != nil && !reflect.DeepEqual(current.endpoints, next.endpoints) {
+
+		next.health = newHealthChecker(*startConfig.Options.HealthCheck, next.endpoints)
+		next.health.inherit(current.health)
+		next.health.start()
+
+	}
+
+	return next, nil
+
+}
+
+// describeChanges summarizes what is different between two states
+func describeChanges(before, after *discoveryState) []string {
+
+	// the changes
+	changes := []string{}
+
+	// the groups are listed by name
+	if added, removed, changed := diffKeys(before.endpoints, after.endpoints); len(added)+len(removed)+len(changed) != 0 {
+
+		changes = append(changes, "endpoints: "+describeKeys(added, removed, changed, true))
+
+	}
+
+	// the rules are counted
+	if !reflect.DeepEqual(before.denyRules, after.denyRules) {
+
+		changes = append(changes, fmt.Sprintf("denyRules: %d rules, was %d", len(after.denyRules), len(before.denyRules)))
+
+	}
+	if !reflect.DeepEqual(before.routes, after.routes) {
+
+		changes = append(changes, fmt.Sprintf("routes: %d routes, was %d", len(after.routes), len(before.routes)))
+
+	}
+	if !reflect.DeepEqual(before.rollouts, after.rollouts) {
+
+		changes = append(changes, fmt.Sprintf("rollouts: %d rollouts, was %d", len(after.rollouts), len(before.rollouts)))
+
+	}
+
+	// maintenance shows if it's on
+	if !reflect.DeepEqual(before.maintenance, after.maintenance) {
+
+		changes = append(changes, fmt.Sprintf("options.maintenance: changed (inMaintenance: %t, was %t)", after.maintenance.InMaintenance, before.maintenance.InMaintenance))
+
+	}
+	if !reflect.DeepEqual(before.bypass, after.bypass) {
+
+		changes = append(changes, "options.maintenanceBypass: changed")
+
+	}
+
+	// the servicetokens are only counted, so they don't end up in the log
+	if added, removed, changed := diffKeys(before.bans, after.bans); len(added)+len(removed)+len(changed) != 0 {
+
+		changes = append(changes, "options.bans: "+describeKeys(added, removed, changed, false))
+
+	}
+	if added, removed, changed := diffKeys(ipBanMap(before.ipBans), ipBanMap(after.ipBans)); len(added)+len(removed)+len(changed) != 0 {
+
+		changes = append(changes, "options.ipBans: "+describeKeys(added, removed, changed, true))
+
+	}
+	if added, removed, changed := diffKeys(before.groupdefs, after.groupdefs); len(added)+len(removed)+len(changed) != 0 {
+
+		changes = append(changes, "groupdefs: "+describeKeys(added, removed, changed, false))
+
+	}
+
+	return changes
+
+}
+
+// diffKeys compares two maps with string keys, returning the keys that were added,
+// removed and changed, sorted
+func diffKeys(before, after interface{}) (added, removed, changed []string) {
+
+	// look at both of them
+	from, to := reflect.ValueOf(before), reflect.ValueOf(after)
+
+	// find the keys that were removed or changed
+	for _, key := range from.MapKeys() {
+
+		value := to.MapIndex(key)
+		if !value.IsValid() {
+
+			removed = append(removed, key.String())
+
+		} else if !reflect.DeepEqual(from.MapIndex(key).Interface(), value.Interface()) {
+
+			changed = append(changed, key.String())
+
+		}
+
+	}
+
+	// and the ones that were added
+	for _, key := range to.MapKeys() {
+
+		if !from.MapIndex(key).IsValid() {
+
+			added = append(added, key.String())
+
+		}
+
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+
+}
+
+// describeKeys formats the keys that were added, removed and changed, either by name or
+// by how many there are
+func describeKeys(added, removed, changed []string, named bool) string {
+
+	// the parts of it
+	parts := []string{}
+
+	// describe each of them
+	for _, part := range []struct {
+		verb string
+		keys []string
+	}{{"added", added}, {"removed", removed}, {"changed", changed}} {
+
+		if len(part.keys) == 0 {
+
+			continue
+
+		}
+
+		if named == true {
+
+			parts = append(parts, fmt.Sprintf("%s %s", part.verb, strings.Join(part.keys, ", ")))
+
+		} else {
+
+			parts = append(parts, fmt.Sprintf("%s %d", part.verb, len(part.keys)))
+
+		}
+
+	}
+
+	return strings.Join(parts, "; ")
+
+}
+
+// ipBanMap keys the ip bans by their network, so they can be compared
+func ipBanMap(bans []ipBan) map[string]ipBan {
+
+	// the keyed bans
+	keyed := make(map[string]ipBan, len(bans))
+	for _, banned := range bans {
+
+		keyed[banned.Network.String()] = banned
+
+	}
+
+	return keyed
+
+}
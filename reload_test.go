@@ -0,0 +1,98 @@
+/*
+
+discovery/reload_test.go
+
+tests for building the state a reloaded config asks for
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testConfig parses a config with the ip bans given
+func testConfig(t *testing.T, ipBans string) *configuration {
+
+	config, err := parseConfig([]byte(fmt.Sprintf(`
+options:
+  https: false
+  port: 5432
+  endpoint: "/miiverse/xml"
+  logfile: "discovery.log"
+  hashCost: 4
+  overrideDiscovery: false
+  maintenance:
+    inMaintenance: false
+  ipBans: %s
+endpoints:
+  default: {discovery: d, api: a, wiiu: w, 3ds: n}
+`, ipBans)))
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+
+	return config
+
+}
+
+func TestReloadStateKeepsMovedSources(t *testing.T) {
+
+	// a file with ip bans in it
+	file := filepath.Join(t.TempDir(), "ipbans.json")
+	if err := os.WriteFile(file, []byte(`{}`), 0644); err != nil {
+
+		t.Fatal(err)
+
+	}
+	inline := testConfig(t, `{"203.0.113.0/24": {reason: "inline"}}`)
+	otherInline := testConfig(t, `{"198.51.100.0/24": {reason: "changed"}}`)
+	fromFile := testConfig(t, fmt.Sprintf("{file: %q}", file))
+	network, err := parseNetwork("192.0.2.0/24")
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+	defer func(config *configuration) { startConfig = config }(startConfig)
+
+	for _, test := range []struct {
+		name              string
+		started, reloaded *configuration
+		expected          string
+	}{
+		{"inline in both", inline, otherInline, "changed"},
+		{"moved into a file", inline, fromFile, "current"},
+		{"moved out of a file", fromFile, inline, "current"},
+	} {
+
+		// the data we have now
+		startConfig = test.started
+		current := newState(test.started)
+		current.ipBans = []ipBan{{Network: network, Reason: "current"}}
+
+		next, err := reloadState(test.reloaded, current)
+		if err != nil {
+
+			t.Fatalf("%s: %v", test.name, err)
+
+		}
+		if len(next.ipBans) != 1 || next.ipBans[0].Reason != test.expected {
+
+			t.Errorf("%s: expected the %s ip bans, got %+v", test.name, test.expected, next.ipBans)
+
+		}
+
+	}
+
+}
@@ -0,0 +1,87 @@
+/*
+
+discovery/rollouts.go
+
+sending a percentage of consoles to a new endpoints group
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// rollout sends a percentage of the consoles that would get the default group to another one
+type rollout struct {
+	Group   string  `json:"group"`
+	Percent float64 `json:"percent"`
+}
+
+// the number of buckets consoles are split into, which allows percentages with two decimal places
+const rolloutBuckets = 10000
+
+// validate checks that a rollout makes sense
+func (r rollout) validate(groups map[string]endpointSet) error {
+
+	// the group has to exist
+	if _, ok := groups[r.Group]; !ok {
+
+		return fmt.Errorf("unknown endpoints group %q", r.Group)
+
+	}
+
+	// and the percentage has to be one
+	if r.Percent < 0 || r.Percent > 100 {
+
+		return fmt.Errorf("percent must be between 0 and 100, not %v", r.Percent)
+
+	}
+
+	return nil
+
+}
+
+// rolloutBucket puts a console in one of the buckets of a rollout. the same console always
+// ends up in the same bucket for the same group, so raising the percentage only ever adds
+// consoles to it, while each group still gets a different set of consoles
+func rolloutBucket(group, identity string) int {
+
+	// hash the group along with the console
+	sum := sha256.Sum256([]byte(group + "\x00" + identity))
+
+	return int(binary.BigEndian.Uint64(sum[:8]) % rolloutBuckets)
+
+}
+
+// matchRollouts returns the group of the first rollout the console falls into. identity is
+// what the console is bucketed by, which is its fingerprint if it has one
+func matchRollouts(rollouts []rollout, identity string) (string, bool) {
+
+	// consoles without a servicetoken can't be kept in the same bucket
+	if identity == "" {
+
+		return "", false
+
+	}
+
+	// check each rollout
+	for _, candidate := range rollouts {
+
+		if float64(rolloutBucket(candidate.Group, identity)) < candidate.Percent*rolloutBuckets/100 {
+
+			return candidate.Group, true
+
+		}
+
+	}
+
+	return "", false
+
+}
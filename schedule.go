@@ -0,0 +1,455 @@
+/*
+
+discovery/schedule.go
+
+scheduled maintenance windows, either one-off or recurring
+on a cron-style schedule
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how far ahead we look for the next time a recurring window starts
+const scheduleHorizon = 366 * 24 * time.Hour
+
+// cronField is the set of values a single field of a cron schedule allows
+type cronField map[int]bool
+
+// cronSchedule is a parsed "minute hour day-of-month month day-of-week" schedule
+type cronSchedule struct {
+	source     string
+	minutes    cronField
+	hours      cronField
+	days       cronField
+	months     cronField
+	weekdays   cronField
+	anyDay     bool
+	anyWeekday bool
+}
+
+// maintenanceWindow is a period of time where consoles are in maintenance. it either
+// has a start and an end, or a cron schedule saying when it starts and a duration.
+// like a maintenance scope, it can cover only some consoles
+type maintenanceWindow struct {
+	maintenanceScope
+	Start    *time.Time
+	End      *time.Time
+	Cron     *cronSchedule
+	Duration time.Duration
+	Location *time.Location
+}
+
+// windowOccurrence is a single time a window happens
+type windowOccurrence struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Message string    `json:"message,omitempty"`
+	Group   string    `json:"group,omitempty"`
+	Scoped  bool      `json:"scoped"`
+}
+
+// parseCronField parses a single field, which is a comma-separated list of
+// *, values, ranges (a-b) and steps (*/n or a-b/n)
+func parseCronField(field string, min, max int) (cronField, error) {
+
+	// the allowed values
+	values := cronField{}
+
+	// go over each part of the list
+	for _, part := range strings.Split(field, ",") {
+
+		// split off the step
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+
+			parsed, err := strconv.Atoi(part[i+1:])
+			if err != nil || parsed <= 0 {
+
+				return nil, fmt.Errorf("invalid step in %q", part)
+
+			}
+			step = parsed
+			part = part[:i]
+
+		}
+
+		// figure out the range
+		low, high := min, max
+		if part != "*" {
+
+			bounds := strings.SplitN(part, "-", 2)
+
+			parsed, err := strconv.Atoi(bounds[0])
+			if err != nil {
+
+				return nil, fmt.Errorf("invalid value %q", part)
+
+			}
+			low, high = parsed, parsed
+
+			if len(bounds) == 2 {
+
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+
+					return nil, fmt.Errorf("invalid range %q", part)
+
+				}
+
+			} else if step != 1 {
+
+				// a/n means from a to the end
+				high = max
+
+			}
+
+		}
+
+		// make sure it's in bounds
+		if low < min || high > max || low > high {
+
+			return nil, fmt.Errorf("%q is outside of %d-%d", part, min, max)
+
+		}
+
+		// add the values
+		for value := low; value <= high; value += step {
+
+			values[value] = true
+
+		}
+
+	}
+
+	return values, nil
+
+}
+
+// parseCron parses a five field cron schedule
+func parseCron(source string) (*cronSchedule, error) {
+
+	// split it up
+	fields := strings.Fields(source)
+	if len(fields) != 5 {
+
+		return nil, fmt.Errorf("expected 5 fields (minute hour day-of-month month day-of-week), got %d", len(fields))
+
+	}
+
+	// the parsed schedule
+	schedule := &cronSchedule{
+		source:     source,
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+
+	// parse each field
+	var err error
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+
+		return nil, fmt.Errorf("minute: %v", err)
+
+	}
+	if schedule.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+
+		return nil, fmt.Errorf("hour: %v", err)
+
+	}
+	if schedule.days, err = parseCronField(fields[2], 1, 31); err != nil {
+
+		return nil, fmt.Errorf("day of month: %v", err)
+
+	}
+	if schedule.months, err = parseCronField(fields[3], 1, 12); err != nil {
+
+		return nil, fmt.Errorf("month: %v", err)
+
+	}
+	if schedule.weekdays, err = parseCronField(fields[4], 0, 7); err != nil {
+
+		return nil, fmt.Errorf("day of week: %v", err)
+
+	}
+
+	// sunday can be written as either 0 or 7
+	if schedule.weekdays[7] {
+
+		schedule.weekdays[0] = true
+
+	}
+
+	return schedule, nil
+
+}
+
+// String returns the schedule as it was written
+func (c *cronSchedule) String() string {
+
+	return c.source
+
+}
+
+// dayMatches checks the day of the month and the day of the week. like cron, if
+// both are restricted, either one matching is enough
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+
+	// check both of them
+	day := c.days[t.Day()]
+	weekday := c.weekdays[int(t.Weekday())]
+
+	switch {
+
+	case c.anyDay && c.anyWeekday:
+		return true
+
+	case c.anyDay:
+		return weekday
+
+	case c.anyWeekday:
+		return day
+
+	}
+
+	return day || weekday
+
+}
+
+// matches checks if the schedule fires at the minute t is in
+func (c *cronSchedule) matches(t time.Time) bool {
+
+	return c.minutes[t.Minute()] && c.hours[t.Hour()] && c.months[int(t.Month())] && c.dayMatches(t)
+
+}
+
+// next returns the first minute at or after t that the schedule fires at
+func (c *cronSchedule) next(t time.Time, limit time.Time) (time.Time, bool) {
+
+	// start at the beginning of the minute
+	t = t.Truncate(time.Minute)
+	if t.Before(limit) == false {
+
+		return time.Time{}, false
+
+	}
+
+	// skip over whatever doesn't match, a month, day or hour at a time where we can
+	for t.Before(limit) {
+
+		switch {
+
+		case !c.months[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+
+		case !c.hours[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+
+		case !c.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+
+		default:
+			return t, true
+
+		}
+
+	}
+
+	return time.Time{}, false
+
+}
+
+// current returns the occurrence of the window that now is in, if there is one
+func (w maintenanceWindow) current(now time.Time) (time.Time, time.Time, bool) {
+
+	// one-off windows are simple
+	if w.Cron == nil {
+
+		if w.Start != nil && w.End != nil && !now.Before(*w.Start) && now.Before(*w.End) {
+
+			return *w.Start, *w.End, true
+
+		}
+
+		return time.Time{}, time.Time{}, false
+
+	}
+
+	// recurring windows are in progress if they started within the last duration. the
+	// schedule only fires on whole minutes, so that's the first one after now minus the
+	// duration, up to the minute now is in
+	local := now.In(w.Location)
+	from := local.Add(-w.Duration).Truncate(time.Minute).Add(time.Minute)
+	start, ok := w.Cron.next(from, local.Truncate(time.Minute).Add(time.Minute))
+	if !ok || start.After(local) {
+
+		return time.Time{}, time.Time{}, false
+
+	}
+
+	return start, start.Add(w.Duration), true
+
+}
+
+// upcoming returns the occurrence of the window that is in progress, or the next one
+func (w maintenanceWindow) upcoming(now time.Time) (time.Time, time.Time, bool) {
+
+	// check if one is in progress
+	if start, end, ok := w.current(now); ok {
+
+		return start, end, true
+
+	}
+
+	// one-off windows only happen once
+	if w.Cron == nil {
+
+		if w.Start != nil && w.End != nil && now.Before(*w.Start) {
+
+			return *w.Start, *w.End, true
+
+		}
+
+		return time.Time{}, time.Time{}, false
+
+	}
+
+	// recurring ones happen the next time the schedule fires
+	local := now.In(w.Location)
+	start, ok := w.Cron.next(local, local.Add(scheduleHorizon))
+	if !ok {
+
+		return time.Time{}, time.Time{}, false
+
+	}
+
+	return start, start.Add(w.Duration), true
+
+}
+
+// schedule returns the occurrence of every window that is in progress or coming
+// up next, sorted by when they start
+func (m maintenanceStatus) schedule(now time.Time) []windowOccurrence {
+
+	// the occurrences
+	occurrences := []windowOccurrence{}
+
+	// find each of them
+	for _, window := range m.Windows {
+
+		if start, end, ok := window.upcoming(now); ok {
+
+			occurrences = append(occurrences, windowOccurrence{
+				Start:   start,
+				End:     end,
+				Message: messageOr(window.Message, messageOr(m.Message, defaultMaintenanceMessage)),
+				Group:   window.Group,
+				Scoped:  window.scoped(),
+			})
+
+		}
+
+	}
+
+	// sort them
+	for i := 1; i < len(occurrences); i++ {
+
+		for j := i; j > 0 && occurrences[j].Start.Before(occurrences[j-1].Start); j-- {
+
+			occurrences[j], occurrences[j-1] = occurrences[j-1], occurrences[j]
+
+		}
+
+	}
+
+	return occurrences
+
+}
+
+// maintenanceWindowJSON is a maintenance window, as it is sent by a url
+type maintenanceWindowJSON struct {
+	maintenanceScopeJSON
+	Start    *time.Time `json:"start"`
+	End      *time.Time `json:"end"`
+	Cron     string     `json:"cron"`
+	Duration string     `json:"duration"`
+	Timezone string     `json:"timezone"`
+}
+
+// newMaintenanceWindow checks and fills in a window, whichever way it was written
+func newMaintenanceWindow(scope maintenanceScope, start, end *time.Time, cron, duration, timezone string) (maintenanceWindow, error) {
+
+	// the window
+	window := maintenanceWindow{maintenanceScope: scope, Start: start, End: end, Location: time.UTC}
+
+	// timezones only matter for recurring windows, since timestamps already have one
+	if timezone != "" {
+
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+
+			return window, fmt.Errorf("invalid timezone: %v", err)
+
+		}
+		window.Location = location
+
+	}
+
+	// it's either one-off
+	if cron == "" {
+
+		if start == nil || end == nil {
+
+			return window, fmt.Errorf("a window needs either a start and an end, or a cron schedule and a duration")
+
+		}
+		if !end.After(*start) {
+
+			return window, fmt.Errorf("the end must be after the start")
+
+		}
+		if duration != "" {
+
+			return window, fmt.Errorf("duration is only used with a cron schedule")
+
+		}
+
+		return window, nil
+
+	}
+
+	// or recurring
+	if start != nil || end != nil {
+
+		return window, fmt.Errorf("a window can't have both a cron schedule and a start or an end")
+
+	}
+	schedule, err := parseCron(cron)
+	if err != nil {
+
+		return window, fmt.Errorf("invalid cron schedule: %v", err)
+
+	}
+	window.Cron = schedule
+
+	// which needs to know how long it lasts
+	if window.Duration, err = time.ParseDuration(duration); err != nil || window.Duration <= 0 {
+
+		return window, fmt.Errorf("a recurring window needs a positive duration, like 2h")
+
+	}
+
+	return window, nil
+
+}
@@ -0,0 +1,176 @@
+/*
+
+discovery/schedule_test.go
+
+tests for cron schedules and maintenance windows
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+
+	for _, test := range []struct {
+		source string
+		fails  bool
+	}{
+		{"* * * * *", false},
+		{"0 3 * * 0", false},
+		{"*/15 0-6 1,15 * 1-5", false},
+		{"30 2 * 1-12/3 7", false},
+		{"5/20 * * * *", false},
+		{"* * * *", true},
+		{"* * * * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"*/0 * * * *", true},
+		{"5-1 * * * *", true},
+		{"a * * * *", true},
+		{"1-b * * * *", true},
+	} {
+
+		_, err := parseCron(test.source)
+		if test.fails == true && err == nil {
+
+			t.Errorf("%q: expected an error", test.source)
+
+		} else if test.fails == false && err != nil {
+
+			t.Errorf("%q: %v", test.source, err)
+
+		}
+
+	}
+
+}
+
+func TestCronFields(t *testing.T) {
+
+	// steps from a value go to the end of the range
+	schedule, err := parseCron("5/20 * * * 7")
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+	for minute, expected := range map[int]bool{5: true, 25: true, 45: true, 0: false, 20: false} {
+
+		if schedule.minutes[minute] != expected {
+
+			t.Errorf("minute %d: expected %t", minute, expected)
+
+		}
+
+	}
+
+	// sunday can be written as 7
+	if !schedule.weekdays[0] {
+
+		t.Error("expected 7 to mean sunday")
+
+	}
+
+}
+
+func TestCronDayMatches(t *testing.T) {
+
+	// like cron, either the day of the month or the day of the week is enough when both are restricted
+	schedule, err := parseCron("0 0 13 * 5")
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+	for day, expected := range map[string]bool{
+		"2026-03-13": true,  // a friday the 13th
+		"2026-03-20": true,  // a friday
+		"2026-04-13": true,  // a monday the 13th
+		"2026-04-14": false, // a tuesday
+	} {
+
+		date, _ := time.Parse("2006-01-02", day)
+		if schedule.dayMatches(date) != expected {
+
+			t.Errorf("%s: expected %t", day, expected)
+
+		}
+
+	}
+
+}
+
+func TestMaintenanceWindowCurrent(t *testing.T) {
+
+	// the windows
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+
+		t.Skipf("no timezone data: %v", err)
+
+	}
+	window := func(cron string, duration time.Duration, location *time.Location) maintenanceWindow {
+
+		schedule, err := parseCron(cron)
+		if err != nil {
+
+			t.Fatal(err)
+
+		}
+		return maintenanceWindow{Cron: schedule, Duration: duration, Location: location}
+
+	}
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	oneOff := maintenanceWindow{Start: &start, End: &end, Location: time.UTC}
+	daily := window("0 10 * * *", time.Hour, time.UTC)
+	short := window("0 10 * * *", 90*time.Second, time.UTC)
+
+	// the schedule is in local time, and durations are real time, so the one on the
+	// day the clocks go forward ends at 4:00 instead of 3:00
+	springForward := window("0 1 * * *", 2*time.Hour, newYork)
+
+	for _, test := range []struct {
+		name     string
+		window   maintenanceWindow
+		now      time.Time
+		expected bool
+	}{
+		{"one-off, before it starts", oneOff, start.Add(-time.Second), false},
+		{"one-off, when it starts", oneOff, start, true},
+		{"one-off, just before it ends", oneOff, end.Add(-time.Second), true},
+		{"one-off, when it ends", oneOff, end, false},
+		{"daily, the minute before it starts", daily, time.Date(2026, 5, 1, 9, 59, 0, 0, time.UTC), false},
+		{"daily, seconds before it starts", daily, time.Date(2026, 5, 1, 9, 59, 30, 0, time.UTC), false},
+		{"daily, when it starts", daily, time.Date(2026, 5, 1, 10, 0, 0, 0, time.UTC), true},
+		{"daily, just before it ends", daily, time.Date(2026, 5, 1, 10, 59, 59, 0, time.UTC), true},
+		{"daily, when it ends", daily, time.Date(2026, 5, 1, 11, 0, 0, 0, time.UTC), false},
+		{"a duration that isn't whole minutes, just before it ends", short, time.Date(2026, 5, 1, 10, 1, 29, 0, time.UTC), true},
+		{"a duration that isn't whole minutes, when it ends", short, time.Date(2026, 5, 1, 10, 1, 30, 0, time.UTC), false},
+		{"across dst, before the clocks go forward", springForward, time.Date(2026, 3, 8, 1, 30, 0, 0, newYork), true},
+		{"across dst, after the clocks go forward", springForward, time.Date(2026, 3, 8, 3, 30, 0, 0, newYork), true},
+		{"across dst, when it ends", springForward, time.Date(2026, 3, 8, 4, 0, 0, 0, newYork), false},
+		{"across dst, in another timezone", springForward, time.Date(2026, 3, 8, 7, 30, 0, 0, time.UTC), true},
+	} {
+
+		from, _, ok := test.window.current(test.now)
+		if ok != test.expected {
+
+			t.Errorf("%s: expected %t, got %t (started %s)", test.name, test.expected, ok, from)
+
+		}
+
+	}
+
+}
@@ -0,0 +1,169 @@
+/*
+
+discovery/signature.go
+
+checking that the data pulled from urls was signed by someone we trust
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the header the signature is sent in, unless another one is configured
+const defaultSignatureHeader = "X-Signature"
+
+// decodeSignatureBytes decodes a key or a signature of a known size, written either in
+// hexadecimal or in base64
+func decodeSignatureBytes(value string, size int) ([]byte, error) {
+
+	// values are compared without surrounding whitespace
+	value = strings.TrimSpace(value)
+
+	// check if it's hexadecimal
+	if len(value) == size*2 {
+
+		if decoded, err := hex.DecodeString(value); err == nil {
+
+			return decoded, nil
+
+		}
+
+	}
+
+	// otherwise, it has to be base64, padded or not, in either alphabet
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+
+		if decoded, err := encoding.DecodeString(value); err == nil {
+
+			if len(decoded) != size {
+
+				return nil, fmt.Errorf("expected %d bytes, got %d", size, len(decoded))
+
+			}
+
+			return decoded, nil
+
+		}
+
+	}
+
+	return nil, errors.New("expected hexadecimal or base64")
+
+}
+
+// parsePublicKey parses an ed25519 public key
+func parsePublicKey(key string) (ed25519.PublicKey, error) {
+
+	// decode it
+	decoded, err := decodeSignatureBytes(key, ed25519.PublicKeySize)
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	return ed25519.PublicKey(decoded), nil
+
+}
+
+// signatureTimestampHeader returns the header the time data was signed at is sent in,
+// which is the signature header with -Timestamp on the end (X-Signature-Timestamp)
+func signatureTimestampHeader(signatureHeader string) string {
+
+	return signatureHeader + "-Timestamp"
+
+}
+
+// parseSignatureTimestamp parses the time data was signed at, in seconds since the epoch
+func parseSignatureTimestamp(timestamp string) (time.Time, error) {
+
+	// parse it
+	seconds, err := strconv.ParseInt(strings.TrimSpace(timestamp), 10, 64)
+	if err != nil {
+
+		return time.Time{}, errors.New("missing or invalid signature timestamp")
+
+	}
+
+	return time.Unix(seconds, 0), nil
+
+}
+
+// verifySignature checks that data was signed by one of the keys. the signature is of
+// the timestamp, a period and the data, so old data can't be sent again as if it were
+// new: data signed before current (the time the data we have was signed at) is
+// rejected, and so is data signed more than maxAge seconds ago, if there's a limit.
+// it returns the time the data was signed at
+func verifySignature(keys []ed25519.PublicKey, data []byte, signature, timestamp string, current time.Time, maxAge int, now time.Time) (time.Time, error) {
+
+	// it has to be there
+	if signature == "" {
+
+		return time.Time{}, errors.New("the data isn't signed")
+
+	}
+
+	// decode it
+	decoded, err := decodeSignatureBytes(signature, ed25519.SignatureSize)
+	if err != nil {
+
+		return time.Time{}, fmt.Errorf("invalid signature: %v", err)
+
+	}
+
+	// and the time it was signed at
+	signedAt, err := parseSignatureTimestamp(timestamp)
+	if err != nil {
+
+		return time.Time{}, err
+
+	}
+
+	// check it against each key
+	message := append([]byte(strings.TrimSpace(timestamp)+"."), data...)
+	verified := false
+	for _, key := range keys {
+
+		if ed25519.Verify(key, message, decoded) {
+
+			verified = true
+			break
+
+		}
+
+	}
+	if verified == false {
+
+		return time.Time{}, errors.New("the signature doesn't match any of the public keys")
+
+	}
+
+	// make sure it isn't older than what we have
+	if signedAt.Before(current) {
+
+		return time.Time{}, fmt.Errorf("the data was signed at %s, before the data we have (signed at %s)", signedAt.UTC().Format(time.RFC3339), current.UTC().Format(time.RFC3339))
+
+	}
+	if maxAge > 0 && now.Sub(signedAt) > time.Duration(maxAge)*time.Second {
+
+		return time.Time{}, fmt.Errorf("the data was signed at %s, more than %d seconds ago", signedAt.UTC().Format(time.RFC3339), maxAge)
+
+	}
+
+	return signedAt, nil
+
+}
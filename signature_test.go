@@ -0,0 +1,200 @@
+/*
+
+discovery/signature_test.go
+
+tests for checking the signatures on data pulled from urls
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"crypto/ed25519"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// signTestData signs data the way a moderation backend does, returning the signature
+// and the timestamp
+func signTestData(key ed25519.PrivateKey, data string, signedAt time.Time) (string, string) {
+
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	return hex.EncodeToString(ed25519.Sign(key, []byte(timestamp+"."+data))), timestamp
+
+}
+
+// testKeys generates a key pair
+func testKeys(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+
+	return public, private
+
+}
+
+func TestVerifySignature(t *testing.T) {
+
+	// the keys
+	public, private := testKeys(t)
+	_, other := testKeys(t)
+	keys := []ed25519.PublicKey{public}
+	now := time.Unix(1700000000, 0)
+	data := `{"servicetoken": {"reason": "banned"}}`
+	signature, timestamp := signTestData(private, data, now.Add(-time.Minute))
+	otherSignature, _ := signTestData(other, data, now.Add(-time.Minute))
+
+	for _, test := range []struct {
+		name, data, signature, timestamp string
+		current                          time.Time
+		maxAge                           int
+		fails                            bool
+	}{
+		{"signed", data, signature, timestamp, time.Time{}, 0, false},
+		{"signed when the data we have was", data, signature, timestamp, now.Add(-time.Minute), 0, false},
+		{"signed within the max age", data, signature, timestamp, time.Time{}, 61, false},
+		{"a tampered body", data + " ", signature, timestamp, time.Time{}, 0, true},
+		{"a tampered timestamp", data, signature, strconv.FormatInt(now.Unix(), 10), time.Time{}, 0, true},
+		{"unsigned", data, "", "", time.Time{}, 0, true},
+		{"without a timestamp", data, signature, "", time.Time{}, 0, true},
+		{"signed with another key", data, otherSignature, timestamp, time.Time{}, 0, true},
+		{"a signature that isn't one", data, "nope", timestamp, time.Time{}, 0, true},
+		{"older than the data we have", data, signature, timestamp, now, 0, true},
+		{"older than the max age", data, signature, timestamp, time.Time{}, 59, true},
+	} {
+
+		_, err := verifySignature(keys, []byte(test.data), test.signature, test.timestamp, test.current, test.maxAge, now)
+		if test.fails == true && err == nil {
+
+			t.Errorf("%s: expected an error", test.name)
+
+		} else if test.fails == false && err != nil {
+
+			t.Errorf("%s: %v", test.name, err)
+
+		}
+
+	}
+
+}
+
+func TestPollKeepsDataWhenSignaturesAreRejected(t *testing.T) {
+
+	// the log would be far too long
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+
+	// a url whose response can be changed
+	public, private := testKeys(t)
+	var lock sync.Mutex
+	var body, signature, timestamp string
+	serve := func(data string, signedAt time.Time, tamper bool) {
+
+		lock.Lock()
+		defer lock.Unlock()
+		body, signature, timestamp = data, "", ""
+		if !signedAt.IsZero() {
+
+			signature, timestamp = signTestData(private, data, signedAt)
+
+		}
+		if tamper == true {
+
+			body += " "
+
+		}
+
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		lock.Lock()
+		defer lock.Unlock()
+		if signature != "" {
+
+			w.Header().Set("X-Signature", signature)
+			w.Header().Set("X-Signature-Timestamp", timestamp)
+
+		}
+		w.Write([]byte(body))
+
+	}))
+	defer server.Close()
+
+	// a poller that remembers what it applied
+	var applied string
+	remote := remoteSource{URL: server.URL, PublicKeys: []ed25519.PublicKey{public}, SignatureHeader: defaultSignatureHeader, SignatureMaxAge: 3600}
+	cache := filepath.Join(t.TempDir(), "banlist.json")
+	apply := func(data []byte) error {
+
+		applied = string(data)
+		return nil
+
+	}
+	poller := newSourcePoller("banlist", remote, cache, 1, fetchOptions{RequestTimeout: 5, MaxBackoff: 1}, apply, func() {})
+
+	// the data before and after someone was banned
+	now := time.Now()
+	before, after := `{}`, `{"servicetoken": {"reason": "banned"}}`
+
+	for _, test := range []struct {
+		name     string
+		data     string
+		signedAt time.Time
+		tamper   bool
+		fails    bool
+	}{
+		{"the ban list before the ban", before, now.Add(-2 * time.Minute), false, false},
+		{"the ban list after it", after, now.Add(-time.Minute), false, false},
+		{"the old ban list sent again", before, now.Add(-2 * time.Minute), false, true},
+		{"a tampered ban list", before, now, true, true},
+		{"an unsigned ban list", before, time.Time{}, false, true},
+		{"a ban list signed too long ago", before, now.Add(-2 * time.Hour), false, true},
+	} {
+
+		serve(test.data, test.signedAt, test.tamper)
+		poller.poll()
+		failed := poller.source.report(time.Now()).Failures != 0
+		if failed != test.fails {
+
+			t.Errorf("%s: expected it to fail: %t, got %t", test.name, test.fails, failed)
+
+		}
+		if test.fails == true && applied != after {
+
+			t.Errorf("%s: expected the ban list we had to be kept, got %s", test.name, applied)
+
+		}
+
+	}
+
+	// the cached data is checked the same way
+	applied = ""
+	if _, ok := loadSourceCache("banlist", remote, cache, apply); !ok || applied != after {
+
+		t.Fatalf("expected the cached ban list to be loaded, got %q", applied)
+
+	}
+	remote.SignatureMaxAge = 30
+	if _, ok := loadSourceCache("banlist", remote, cache, apply); ok {
+
+		t.Fatal("expected a cached ban list signed too long ago to be refused")
+
+	}
+
+}
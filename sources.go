@@ -0,0 +1,352 @@
+/*
+
+discovery/sources.go
+
+keeping the data that is pulled from urls up to date
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sourcesReady is done once every source has data, either from its cache or from its url
+var sourcesReady sync.WaitGroup
+
+// the fetchers of every source that is pulled from a url
+var sources []*fetcher
+
+// sourceCache is the last data that was successfully pulled from a url, as it
+// is kept on disk so it can be used if the url is down when discovery starts
+type sourceCache struct {
+	URL       string    `json:"url"`
+	Fetched   time.Time `json:"fetched"`
+	Data      string    `json:"data"`
+	Signature string    `json:"signature,omitempty"`
+	Timestamp string    `json:"timestamp,omitempty"`
+}
+
+// sourceCacheFile returns the file a source is cached in, or nothing if caching is turned off
+func sourceCacheFile(directory, name string) string {
+
+	// check if it's turned off
+	if directory == "" {
+
+		return ""
+
+	}
+
+	return filepath.Join(directory, strings.Replace(name, " ", "-", -1)+".json")
+
+}
+
+// loadSourceCache applies the cached data of a source, if there is any and it came from the same url.
+// it returns the cache, so we know how old the data is. if the source has to be signed,
+// the cached data is checked again, in case someone changed the file
+func loadSourceCache(name string, remote remoteSource, file string, apply func(data []byte) error) (sourceCache, bool) {
+
+	// read it
+	data, err := readFileByte(file)
+	if err != nil {
+
+		// not having one yet is fine
+		if !os.IsNotExist(err) {
+
+			log.Printf("[err]: unable to read the cached %s...\n", name)
+			log.Printf("       error: %v\n", err)
+
+		}
+		return sourceCache{}, false
+
+	}
+
+	// unmarshal it
+	var cached sourceCache
+	if err = json.Unmarshal(data, &cached); err != nil {
+
+		log.Printf("[err]: the cached %s is invalid, ignoring it...\n", name)
+		log.Printf("       error: %v\n", err)
+		return sourceCache{}, false
+
+	}
+
+	// data from another url doesn't count
+	if cached.URL != remote.URL {
+
+		log.Printf("-> the cached %s came from %s, ignoring it...\n", name, cached.URL)
+		return sourceCache{}, false
+
+	}
+
+	// check the signature, which also keeps data that was signed too long ago from being used
+	if len(remote.PublicKeys) != 0 {
+
+		if _, err = verifySignature(remote.PublicKeys, []byte(cached.Data), cached.Signature, cached.Timestamp, time.Time{}, remote.SignatureMaxAge, time.Now()); err != nil {
+
+			log.Printf("[err]: the cached %s was rejected, ignoring it...\n", name)
+			log.Printf("       error: %v\n", err)
+			return sourceCache{}, false
+
+		}
+
+	}
+
+	// apply it
+	if err = apply([]byte(cached.Data)); err != nil {
+
+		log.Printf("[err]: the cached %s is invalid, ignoring it...\n", name)
+		log.Printf("       error: %v\n", err)
+		return sourceCache{}, false
+
+	}
+
+	// let the user know
+	log.Printf("-> loaded %s from the cache (fetched %s)...\n", name, cached.Fetched.Format(time.RFC3339))
+	return cached, true
+
+}
+
+// saveSourceCache keeps the data of a source on disk
+func saveSourceCache(name, url, file string, data []byte, signature, timestamp string) {
+
+	// write it
+	err := writeJSONFile(file, sourceCache{URL: url, Fetched: time.Now(), Data: string(data), Signature: signature, Timestamp: timestamp})
+	if err != nil {
+
+		log.Printf("[err]: unable to cache the %s...\n", name)
+		log.Printf("       error: %v\n", err)
+
+	}
+
+}
+
+// sourcePoller keeps a single source that is pulled from a url up to date
+type sourcePoller struct {
+	name    string
+	cache   string
+	timeout int
+	source  *fetcher
+	apply   func(data []byte) error
+	ready   func()
+	last    []byte
+	stale   bool
+}
+
+// pollSource starts a goroutine that pulls data from a url forever, waiting
+// timeout seconds between each pull, or longer after failing. data that
+// changed is handed to apply, which decides if it's valid and moves it into
+// place. if there is a cache file, the last valid data is loaded from it
+// first, and every change that is applied is saved to it
+func pollSource(name string, remote remoteSource, cache string, timeout int, settings fetchOptions, apply func(data []byte) error) {
+
+	// keep track of when this source first has data
+	var once sync.Once
+	sourcesReady.Add(1)
+
+	// keep track of how it's doing
+	poller := newSourcePoller(name, remote, cache, timeout, settings, apply, func() { once.Do(sourcesReady.Done) })
+	sources = append(sources, poller.source)
+
+	// start with the cached data, if there is any
+	if cache != "" {
+
+		if cached, ok := loadSourceCache(name, remote, cache, apply); ok == true {
+
+			poller.last = []byte(cached.Data)
+			poller.source.applied(cached.Timestamp)
+			poller.source.succeeded(cached.Fetched, true)
+			poller.ready()
+
+		}
+
+	}
+
+	// then pull it forever
+	go func() {
+
+		for {
+
+			time.Sleep(poller.poll())
+
+		}
+
+	}()
+
+}
+
+// newSourcePoller creates a poller for a source. ready is called once it has data
+func newSourcePoller(name string, remote remoteSource, cache string, timeout int, settings fetchOptions, apply func(data []byte) error, ready func()) *sourcePoller {
+
+	return &sourcePoller{
+		name:    name,
+		cache:   cache,
+		timeout: timeout,
+		source:  newFetcher(name, remote, settings),
+		apply:   apply,
+		ready:   ready,
+	}
+
+}
+
+// poll pulls the source once, returning how long to wait before the next time
+func (p *sourcePoller) poll() time.Duration {
+
+	// how long to wait before the next pull
+	wait := time.Duration(p.timeout) * time.Second
+
+	// if the data was changed some other way, put it back the way the url has it
+	if p.source.invalidated() {
+
+		p.source.forget()
+		p.last = nil
+
+	}
+
+	// update the data
+	now := time.Now()
+	p.source.attempted(now)
+	data, err := p.source.fetch()
+	if err == nil && data != nil && !bytes.Equal(data, p.last) {
+
+		// it changed, so check it and move it into place
+		if err = p.apply(data); err != nil {
+
+			// make sure we get it again next time, even if it doesn't change
+			p.source.forget()
+			err = fmt.Errorf("the data is invalid: %v", err)
+
+		}
+
+	}
+
+	if err != nil {
+
+		// show a message and back off
+		failures := p.source.failed(err)
+		wait = p.source.backoff(p.timeout, failures)
+		log.Printf("[err]: unable to update %s (failed %d times in a row), trying again in %s...\n", p.name, failures, wait.Round(time.Second))
+		log.Printf("       error: %v\n", err)
+
+	} else if data != nil && !bytes.Equal(data, p.last) {
+
+		// let the user know
+		log.Printf("-> updated %s...\n", p.name)
+		p.source.applied(p.source.timestamp)
+		p.source.succeeded(now, true)
+		p.ready()
+
+		// keep it in case the url is down next time
+		if p.cache != "" {
+
+			saveSourceCache(p.name, p.source.source.URL, p.cache, data, p.source.signature, p.source.timestamp)
+
+		}
+		p.last = data
+
+	} else {
+
+		// it hasn't changed
+		p.source.succeeded(now, false)
+
+	}
+
+	// let the user know when the data goes stale, and when it's up to date again
+	if p.source.stale(time.Now()) != p.stale {
+
+		p.stale = !p.stale
+		if p.stale {
+
+			log.Printf("[err]: %s hasn't been updated for over %d seconds, failing %s...\n", p.name, p.source.options.MaxAge, p.source.options.StalePolicy)
+
+		} else {
+
+			log.Printf("-> %s is up to date again\n", p.name)
+
+		}
+
+	}
+
+	return wait
+
+}
+
+// findSource returns the fetcher of a source that is pulled from a url, if there is one
+func findSource(name string) *fetcher {
+
+	for _, source := range sources {
+
+		if source.status.Name == name {
+
+			return source
+
+		}
+
+	}
+
+	return nil
+
+}
+
+// reconcileSource makes the next pull of a source apply its data again, if it's pulled from a url
+func reconcileSource(name string) {
+
+	for _, source := range sources {
+
+		if source.status.Name == name {
+
+			source.invalidate()
+
+		}
+
+	}
+
+}
+
+// staleSource returns the name of a source that has gone stale and fails closed, if there is one
+func staleSource(now time.Time) (string, bool) {
+
+	// check each of them
+	for _, source := range sources {
+
+		if source.options.StalePolicy == "closed" && source.stale(now) {
+
+			return source.status.Name, true
+
+		}
+
+	}
+
+	return "", false
+
+}
+
+// sourceStatuses returns what we know about every source that is pulled from a url
+func sourceStatuses(now time.Time) []sourceStatus {
+
+	// the statuses
+	statuses := []sourceStatus{}
+
+	// get each of them
+	for _, source := range sources {
+
+		statuses = append(statuses, source.report(now))
+
+	}
+
+	return statuses
+
+}
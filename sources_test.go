@@ -0,0 +1,347 @@
+/*
+
+discovery/sources_test.go
+
+tests for pulling data from urls, caching it and backing off
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSourceServer is a url whose data can be changed, and which remembers the
+// conditional headers it was sent
+type testSourceServer struct {
+	lock         sync.Mutex
+	data         string
+	etag         string
+	lastModified string
+	status       int
+	requests     []http.Header
+}
+
+// serve changes what the url sends
+func (s *testSourceServer) serve(data, etag, lastModified string, status int) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.data, s.etag, s.lastModified, s.status = data, etag, lastModified, status
+
+}
+
+// last returns the headers of the last request
+func (s *testSourceServer) last() http.Header {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.requests) == 0 {
+
+		return http.Header{}
+
+	}
+
+	return s.requests[len(s.requests)-1]
+
+}
+
+func (s *testSourceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.requests = append(s.requests, r.Header.Clone())
+
+	// fail if it's told to
+	if s.status != 0 {
+
+		w.WriteHeader(s.status)
+		return
+
+	}
+
+	// say it hasn't changed if the client already has it
+	if s.etag != "" && r.Header.Get("If-None-Match") == s.etag {
+
+		w.WriteHeader(http.StatusNotModified)
+		return
+
+	}
+	if s.etag == "" && s.lastModified != "" && r.Header.Get("If-Modified-Since") == s.lastModified {
+
+		w.WriteHeader(http.StatusNotModified)
+		return
+
+	}
+
+	// otherwise, send it
+	if s.etag != "" {
+
+		w.Header().Set("ETag", s.etag)
+
+	}
+	if s.lastModified != "" {
+
+		w.Header().Set("Last-Modified", s.lastModified)
+
+	}
+	w.Write([]byte(s.data))
+
+}
+
+func TestPollOnlyAppliesChangedData(t *testing.T) {
+
+	// the log isn't needed
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+
+	// a url, and a poller that counts what it applies
+	server := &testSourceServer{}
+	listener := httptest.NewServer(server)
+	defer listener.Close()
+	var applied []string
+	valid := true
+	apply := func(data []byte) error {
+
+		if valid == false {
+
+			return errors.New("not valid")
+
+		}
+		applied = append(applied, string(data))
+		return nil
+
+	}
+	poller := newSourcePoller("bans", remoteSource{URL: listener.URL}, "", 60, fetchOptions{RequestTimeout: 5, MaxBackoff: 300}, apply, func() {})
+	monday, tuesday := "Mon, 01 Jan 2024 00:00:00 GMT", "Tue, 02 Jan 2024 00:00:00 GMT"
+
+	for _, test := range []struct {
+		name string
+
+		// what the url sends, and what has happened since the last poll
+		data, etag, lastModified string
+		invalid, invalidate      bool
+
+		// the conditional headers that have to be sent, and what has to be applied
+		ifNoneMatch, ifModifiedSince string
+		applied                      int
+		fails                        bool
+	}{
+		{"the first pull", "{}", `"v1"`, monday, false, false, "", "", 1, false},
+		{"nothing changed", "{}", `"v1"`, monday, false, false, `"v1"`, monday, 1, false},
+		{"it changed", `{"a": {}}`, `"v2"`, tuesday, false, false, `"v1"`, monday, 2, false},
+		{"nothing changed again", `{"a": {}}`, `"v2"`, tuesday, false, false, `"v2"`, tuesday, 2, false},
+		{"it changed to something invalid", `{"b": {}}`, `"v3"`, tuesday, true, false, `"v2"`, tuesday, 2, true},
+		{"the invalid data is asked for again", `{"b": {}}`, `"v3"`, tuesday, false, false, "", "", 3, false},
+		{"only a last modified time", `{"c": {}}`, "", monday, false, false, `"v3"`, tuesday, 4, false},
+		{"nothing changed since then", `{"c": {}}`, "", monday, false, false, "", monday, 4, false},
+		{"the data was changed some other way", `{"c": {}}`, "", monday, false, true, "", "", 5, false},
+	} {
+
+		// change the url, and the data
+		server.serve(test.data, test.etag, test.lastModified, 0)
+		valid = !test.invalid
+		if test.invalidate == true {
+
+			poller.source.invalidate()
+
+		}
+		poller.poll()
+
+		// check what was asked for
+		headers := server.last()
+		if headers.Get("If-None-Match") != test.ifNoneMatch || headers.Get("If-Modified-Since") != test.ifModifiedSince {
+
+			t.Errorf("%s: expected If-None-Match %q and If-Modified-Since %q, got %q and %q", test.name, test.ifNoneMatch, test.ifModifiedSince, headers.Get("If-None-Match"), headers.Get("If-Modified-Since"))
+
+		}
+
+		// and what was applied
+		if len(applied) != test.applied || (test.applied != 0 && applied[len(applied)-1] != test.data && !test.invalid) {
+
+			t.Errorf("%s: expected %d updates ending with %s, got %v", test.name, test.applied, test.data, applied)
+
+		}
+		if failed := poller.source.report(time.Now()).Failures != 0; failed != test.fails {
+
+			t.Errorf("%s: expected it to fail: %t, got %t", test.name, test.fails, failed)
+
+		}
+
+	}
+
+}
+
+func TestBackoffLimits(t *testing.T) {
+
+	// a source pulled every 5 seconds, which waits at most a minute after failing
+	source := newFetcher("bans", remoteSource{}, fetchOptions{MaxBackoff: 60})
+
+	for _, test := range []struct {
+		failures int
+		limit    time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{4, 40 * time.Second},
+		{5, 60 * time.Second},
+		{50, 60 * time.Second},
+	} {
+
+		// it's jittered, so check it a few times
+		for i := 0; i < 100; i++ {
+
+			if wait := source.backoff(5, test.failures); wait < test.limit/2 || wait > test.limit {
+
+				t.Fatalf("after %d failures, expected to wait between %s and %s, got %s", test.failures, test.limit/2, test.limit, wait)
+
+			}
+
+		}
+
+	}
+
+	// the maximum wins over the timeout too
+	source = newFetcher("bans", remoteSource{}, fetchOptions{MaxBackoff: 2})
+	if wait := source.backoff(60, 1); wait > 2*time.Second {
+
+		t.Errorf("expected to wait at most 2s, got %s", wait)
+
+	}
+
+	// and polling a url that is down backs off
+	server := &testSourceServer{}
+	server.serve("", "", "", http.StatusInternalServerError)
+	listener := httptest.NewServer(server)
+	defer listener.Close()
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	poller := newSourcePoller("bans", remoteSource{URL: listener.URL}, "", 5, fetchOptions{RequestTimeout: 5, MaxBackoff: 60}, func([]byte) error { return nil }, func() {})
+	for i := 0; i < 8; i++ {
+
+		if wait := poller.poll(); wait > 60*time.Second {
+
+			t.Fatalf("expected to wait at most 60s, got %s", wait)
+
+		}
+
+	}
+	if failures := poller.source.report(time.Now()).Failures; failures != 8 {
+
+		t.Errorf("expected 8 failures in a row, got %d", failures)
+
+	}
+
+}
+
+func TestStaleSourcesFailClosed(t *testing.T) {
+
+	// the log isn't needed
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+
+	// a config to answer requests with
+	config, err := parseConfig([]byte(stateTestConfig("a")))
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+	defer func(secret string, override bool) {
+
+		fingerprintSecret, overrideDiscovery = secret, override
+
+	}(fingerprintSecret, overrideDiscovery)
+	fingerprintSecret, overrideDiscovery = config.Options.FingerprintSecret, true
+	storeState(newState(config))
+	defer storeState(&discoveryState{})
+
+	// answers a request, returning the error message, if there is one
+	request := func() string {
+
+		r := httptest.NewRequest("GET", "/miiverse/xml", nil)
+		r.Header.Set("X-Nintendo-Servicetoken", "ZmluZQ==")
+		w := httptest.NewRecorder()
+		discoveryHandler(w, r)
+		var response result
+		if err := xml.Unmarshal(w.Body.Bytes(), &response); err != nil {
+
+			t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+
+		}
+		return response.Message
+
+	}
+
+	// a url that has data at first
+	server := &testSourceServer{}
+	server.serve("{}", "", "", 0)
+	listener := httptest.NewServer(server)
+	defer listener.Close()
+	defer func(previous []*fetcher) { sources = previous }(sources)
+
+	for _, policy := range []string{"closed", "open"} {
+
+		// a source that goes stale after a minute
+		poller := newSourcePoller("bans", remoteSource{URL: listener.URL}, "", 5, fetchOptions{RequestTimeout: 5, MaxBackoff: 60, MaxAge: 60, StalePolicy: policy}, func([]byte) error { return nil }, func() {})
+		sources = []*fetcher{poller.source}
+
+		// it's up to date
+		server.serve("{}", "", "", 0)
+		poller.poll()
+		if message := request(); message != "" {
+
+			t.Errorf("%s: expected an answer while the data is up to date, got %q", policy, message)
+
+		}
+
+		// then the url goes down, and the data was last confirmed too long ago
+		server.serve("", "", "", http.StatusInternalServerError)
+		poller.source.succeeded(time.Now().Add(-2*time.Minute), false)
+		poller.poll()
+		name, stale := staleSource(time.Now())
+		if policy == "closed" && (stale == false || name != "bans" || request() != defaultMaintenanceMessage) {
+
+			t.Errorf("%s: expected everyone to be put in maintenance while the data is stale", policy)
+
+		}
+		if policy == "open" && (stale == true || request() != "") {
+
+			t.Errorf("%s: expected requests to still be answered while the data is stale", policy)
+
+		}
+		if poller.source.report(time.Now()).Stale == false {
+
+			t.Errorf("%s: expected the data to be reported as stale", policy)
+
+		}
+
+		// until it's back up
+		server.serve("{}", "", "", 0)
+		poller.poll()
+		if _, stale := staleSource(time.Now()); stale == true || request() != "" {
+
+			t.Errorf("%s: expected requests to be answered once the data is up to date again", policy)
+
+		}
+
+	}
+
+}
@@ -0,0 +1,99 @@
+/*
+
+discovery/state.go
+
+the state requests are answered from, which is swapped out as a
+whole whenever it changes so a request never sees half of an update
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"sync"
+	"sync/atomic"
+)
+
+// discoveryState is everything a request reads that can change while discovery is
+// running. one is never modified once it's stored, so updates copy it, change the
+// copy and store that instead
+type discoveryState struct {
+	endpoints      map[string]endpointSet
+	denyRules      []denyRule
+	routes         []route
+	bypass         *maintenanceBypass
+	health         *healthChecker
+	maintenance    maintenanceStatus
+	bans           map[string]ban
+	banIndex       *tokenIndex
+	ipBans         []ipBan
+	groupdefs      map[string]string
+	groupdefsIndex *tokenIndex
+	rollouts       []rollout
+}
+
+// the current state
+var currentState atomic.Value
+
+// newState creates the state that a config asks for
+func newState(config *configuration) *discoveryState {
+
+	return &discoveryState{
+		endpoints:      config.Endpoints,
+		denyRules:      config.DenyRules,
+		routes:         config.Routes,
+		bypass:         newMaintenanceBypass(config.Options.MaintenanceBypass),
+		maintenance:    config.Options.Maintenance.Status,
+		bans:           config.Options.Bans.Bans,
+		banIndex:       newTokenIndex("bans", banKeys(config.Options.Bans.Bans)),
+		ipBans:         config.Options.IPBans.Bans,
+		groupdefs:      config.Groupdefs.Groupdefs,
+		groupdefsIndex: newTokenIndex("groupdefs", groupdefKeys(config.Groupdefs.Groupdefs)),
+		rollouts:       config.Rollouts.Rollouts,
+	}
+
+}
+
+// updateLock keeps updates from the urls, the files and the webhook from overwriting each other
+var updateLock sync.Mutex
+
+// loadState returns the current state
+func loadState() *discoveryState {
+
+	return currentState.Load().(*discoveryState)
+
+}
+
+// storeState replaces the current state
+func storeState(state *discoveryState) {
+
+	currentState.Store(state)
+
+}
+
+// updateState makes a copy of the current state, changes it and stores it. nothing is
+// stored if the change fails
+func updateState(change func(next *discoveryState) error) error {
+
+	updateLock.Lock()
+	defer updateLock.Unlock()
+
+	// copy it
+	next := *loadState()
+
+	// change it
+	if err := change(&next); err != nil {
+
+		return err
+
+	}
+
+	// store it
+	storeState(&next)
+	return nil
+
+}
@@ -0,0 +1,247 @@
+/*
+
+discovery/state_test.go
+
+tests for answering requests while the state is being updated and reloaded
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// stateTestConfig is a config whose hosts all start with a prefix, so a response
+// that mixes two configs can be spotted
+func stateTestConfig(prefix string) string {
+
+	return fmt.Sprintf(`
+options:
+  https: false
+  port: 5432
+  endpoint: "/miiverse/xml"
+  logfile: "discovery.log"
+  hashCost: 4
+  fingerprintSecret: "a-secret-that-is-long-enough"
+  overrideDiscovery: true
+  maintenance: false
+endpoints:
+  default: {discovery: %[1]s.discovery, api: %[1]s.api, wiiu: %[1]s.wiiu, 3ds: %[1]s.3ds}
+`, prefix)
+
+}
+
+// stillRunning checks if a channel hasn't been closed yet
+func stillRunning(done chan struct{}) bool {
+
+	select {
+
+	case <-done:
+		return false
+
+	default:
+		return true
+
+	}
+
+}
+
+// waitForRequests waits until some more requests have been answered
+func waitForRequests(answered chan struct{}, count int) {
+
+	for i := 0; i < count; i++ {
+
+		<-answered
+
+	}
+
+}
+
+func TestConcurrentRequestsUpdatesAndReloads(t *testing.T) {
+
+	// the two configs that are switched between
+	directory := t.TempDir()
+	files := []string{filepath.Join(directory, "a.yaml"), filepath.Join(directory, "b.yaml")}
+	for i, prefix := range []string{"a", "b"} {
+
+		if err := os.WriteFile(files[i], []byte(stateTestConfig(prefix)), 0644); err != nil {
+
+			t.Fatal(err)
+
+		}
+
+	}
+
+	// start with the first one, the way main does
+	config, err := loadConfig(files[0])
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+	defer func(secret string, override bool, config *configuration) {
+
+		fingerprintSecret, overrideDiscovery, startConfig = secret, override, config
+
+	}(fingerprintSecret, overrideDiscovery, startConfig)
+	fingerprintSecret, overrideDiscovery, startConfig = config.Options.FingerprintSecret, true, config
+	storeState(newState(config))
+	defer storeState(&discoveryState{})
+
+	// the log would be far too long
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+
+	// one console is banned and unbanned over and over. servicetokens are base64, and
+	// the ban is on the fingerprint of the decoded one, like the handler looks it up
+	fineToken, bannedToken := "ZmluZQ==", "YmFubmVk"
+	decoded, err := normalizeServiceToken(bannedToken)
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+	banned := fmt.Sprintf(`{%q: {"reason": "banned"}}`, fingerprint(decoded, fingerprintSecret))
+	var bans int64
+	answered := make(chan struct{}, 1)
+
+	// requests keep being made until every update and reload is done
+	var requests, background sync.WaitGroup
+	done := make(chan struct{})
+	problems := make(chan string, 100)
+	const rounds = 200
+
+	// requests
+	for worker := 0; worker < 4; worker++ {
+
+		requests.Add(1)
+		go func(worker int) {
+
+			defer requests.Done()
+			for i := 0; i < rounds || stillRunning(done); i++ {
+
+				// make the request
+				token := []string{fineToken, bannedToken}[(worker+i)%2]
+				r := httptest.NewRequest("GET", "/miiverse/xml", nil)
+				r.Header.Set("X-Nintendo-Servicetoken", token)
+				w := httptest.NewRecorder()
+				discoveryHandler(w, r)
+				select {
+
+				case answered <- struct{}{}:
+				default:
+
+				}
+
+				// let the updates and reloads run in between, even with a single cpu
+				runtime.Gosched()
+
+				// it has to be answered from one config or the other, never both
+				var response result
+				if err := xml.Unmarshal(w.Body.Bytes(), &response); err != nil {
+
+					problems <- fmt.Sprintf("invalid response %q: %v", w.Body.String(), err)
+					return
+
+				}
+				if token == bannedToken && response.ErrorCode == 7 {
+
+					atomic.AddInt64(&bans, 1)
+					continue
+
+				}
+				prefix := strings.Split(response.Host, ".")[0]
+				if response.HasError != 0 || (prefix != "a" && prefix != "b") || response.APIHost != prefix+".api" || response.N3DSHost != prefix+".3ds" {
+
+					problems <- fmt.Sprintf("inconsistent response for %s: %+v", token, response)
+					return
+
+				}
+
+			}
+
+		}(worker)
+
+	}
+
+	// updates
+	background.Add(1)
+	go func() {
+
+		defer background.Done()
+		for i := 0; i < rounds; i++ {
+
+			data := []string{banned, "{}"}[i%2]
+			if err := applyBans([]byte(data)); err != nil {
+
+				problems <- fmt.Sprintf("unable to update the bans: %v", err)
+				return
+
+			}
+			if err := applyIPBansDelta([]byte(`{"203.0.113.0/24": {"reason": "no"}}`), []string{"198.51.100.0/24"}); err != nil {
+
+				problems <- fmt.Sprintf("unable to update the ip bans: %v", err)
+				return
+
+			}
+
+			// let some requests be answered with it
+			waitForRequests(answered, 2)
+
+		}
+
+	}()
+
+	// reloads
+	background.Add(1)
+	go func() {
+
+		defer background.Done()
+		for i := 0; i < rounds/10; i++ {
+
+			if reloadConfig(files[i%2]) == false {
+
+				problems <- fmt.Sprintf("unable to reload %s", files[i%2])
+				return
+
+			}
+			waitForRequests(answered, 2)
+
+		}
+
+	}()
+
+	background.Wait()
+	close(done)
+	requests.Wait()
+	close(problems)
+	for problem := range problems {
+
+		t.Error(problem)
+
+	}
+
+	// the ban has to have been in place for some of the requests
+	if bans == 0 {
+
+		t.Error("expected some of the requests to be banned")
+
+	}
+
+}
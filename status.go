@@ -0,0 +1,123 @@
+/*
+
+discovery/status.go
+
+the status endpoint, which shows what discovery currently thinks
+of the hosts and groups it sends consoles to, when maintenance is scheduled
+and how up to date the data pulled from urls is
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the token needed to see the status, if there is one
+var statusToken string
+
+// statusOptions is the status section of the options
+type statusOptions struct {
+	Endpoint string
+	Token    string
+}
+
+// groupStatus is the status of an endpoints group
+type groupStatus struct {
+	Healthy  bool   `json:"healthy"`
+	Fallback string `json:"fallback,omitempty"`
+}
+
+// maintenanceReport is the maintenance status, along with the scheduled windows
+// that are in progress or coming up next
+type maintenanceReport struct {
+	InMaintenance bool               `json:"inMaintenance"`
+	Windows       []windowOccurrence `json:"windows"`
+}
+
+// statusReport is what the status endpoint responds with
+type statusReport struct {
+	Time        time.Time              `json:"time"`
+	Groups      map[string]groupStatus `json:"groups"`
+	Hosts       []hostHealth           `json:"hosts"`
+	Maintenance maintenanceReport      `json:"maintenance"`
+	Sources     []sourceStatus         `json:"sources"`
+}
+
+// authorized checks that a request to the status endpoint has the right token
+func authorized(r *http.Request, token string) bool {
+
+	// anyone can see it if there is no token
+	if token == "" {
+
+		return true
+
+	}
+
+	// otherwise, it has to be sent as a bearer token
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+
+}
+
+// the handler for the status endpoint
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+
+	// check that they're allowed to see it
+	if !authorized(r, statusToken) {
+
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+
+	}
+
+	// build the report
+	state := loadState()
+	now := time.Now()
+	_, inMaintenance := state.maintenance.global(now)
+	report := statusReport{
+		Time:   now,
+		Groups: map[string]groupStatus{},
+		Hosts:  state.health.status(),
+		Maintenance: maintenanceReport{
+			InMaintenance: inMaintenance,
+			Windows:       state.maintenance.schedule(now),
+		},
+		Sources: sourceStatuses(now),
+	}
+	for name, group := range state.endpoints {
+
+		_, healthy := group.pick("", state.health, overrideDiscovery)
+		report.Groups[name] = groupStatus{Healthy: healthy, Fallback: group.Fallback}
+
+	}
+
+	// marshal it
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+
+		// output an error message if an error occured
+		log.Printf("[err]: could not marshal the status...\n")
+		log.Printf("       error: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+
+	}
+
+	// send it
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+
+}
@@ -0,0 +1,327 @@
+/*
+
+discovery/updates.go
+
+applying updates to the data that can change while discovery
+is running, whether they're pulled from a url or pushed to
+the webhook
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// applyMaintenance replaces the maintenance status
+func applyMaintenance(data []byte) error {
+
+	return updateState(func(next *discoveryState) error {
+
+		// parse the status
+		status, err := parseMaintenance(data, next.endpoints)
+		if err != nil {
+
+			return err
+
+		}
+
+		// move this data into the state
+		next.maintenance = status
+		return nil
+
+	})
+
+}
+
+// applyBans replaces the banlist
+func applyBans(data []byte) error {
+
+	// temporary variable for unpacking the data
+	var tmp map[string]ban
+
+	// unmarshal json data gotten from the url
+	if err := json.Unmarshal(data, &tmp); err != nil {
+
+		return err
+
+	}
+
+	// move this data into the state
+	index := newTokenIndex("bans", banKeys(tmp))
+	return updateState(func(next *discoveryState) error {
+
+		next.banIndex = index
+		next.bans = tmp
+		return nil
+
+	})
+
+}
+
+// applyBansDelta adds, changes and removes some of the bans
+func applyBansDelta(set json.RawMessage, remove []string) error {
+
+	// temporary variable for unpacking the data
+	tmp := map[string]ban{}
+
+	// unmarshal the bans that are added or changed
+	if len(set) != 0 {
+
+		if err := json.Unmarshal(set, &tmp); err != nil {
+
+			return err
+
+		}
+
+	}
+
+	return updateState(func(next *discoveryState) error {
+
+		// copy the current bans, leaving out the removed ones
+		bans := make(map[string]ban, len(next.bans)+len(tmp))
+		for key, entry := range next.bans {
+
+			bans[key] = entry
+
+		}
+		for _, key := range remove {
+
+			delete(bans, key)
+
+		}
+
+		// then add the new ones
+		for key, entry := range tmp {
+
+			bans[key] = entry
+
+		}
+
+		// move this data into the state
+		next.banIndex = newTokenIndex("bans", banKeys(bans))
+		next.bans = bans
+		return nil
+
+	})
+
+}
+
+// applyIPBans replaces the ip bans
+func applyIPBans(data []byte) error {
+
+	// temporary variable for unpacking the data
+	var tmp map[string]ipBanEntry
+
+	// unmarshal json data gotten from the url
+	if err := json.Unmarshal(data, &tmp); err != nil {
+
+		return err
+
+	}
+
+	// move this data into the state
+	bans := newIPBans(tmp)
+	return updateState(func(next *discoveryState) error {
+
+		next.ipBans = bans
+		return nil
+
+	})
+
+}
+
+// applyIPBansDelta adds, changes and removes some of the ip bans
+func applyIPBansDelta(set json.RawMessage, remove []string) error {
+
+	// temporary variable for unpacking the data
+	tmp := map[string]ipBanEntry{}
+
+	// unmarshal the bans that are added or changed
+	if len(set) != 0 {
+
+		if err := json.Unmarshal(set, &tmp); err != nil {
+
+			return err
+
+		}
+
+	}
+
+	// the networks that are replaced or removed
+	replaced := map[string]bool{}
+	for _, network := range remove {
+
+		parsed, err := parseNetwork(network)
+		if err != nil {
+
+			return err
+
+		}
+		replaced[parsed.String()] = true
+
+	}
+	for network := range tmp {
+
+		parsed, err := parseNetwork(network)
+		if err != nil {
+
+			return err
+
+		}
+		replaced[parsed.String()] = true
+
+	}
+
+	return updateState(func(next *discoveryState) error {
+
+		// keep the bans that aren't replaced or removed, and add the new ones
+		bans := []ipBan{}
+		for _, banned := range next.ipBans {
+
+			if !replaced[banned.Network.String()] {
+
+				bans = append(bans, banned)
+
+			}
+
+		}
+
+		// move this data into the state
+		next.ipBans = append(bans, newIPBans(tmp)...)
+		return nil
+
+	})
+
+}
+
+// checkGroupdefs drops any groupdefs that point at groups we don't have
+func checkGroupdefs(groupdefs map[string]string, endpoints map[string]endpointSet) {
+
+	for hash, group := range groupdefs {
+
+		if _, ok := endpoints[group]; !ok {
+
+			log.Printf("[err]: groupdef %s points at unknown endpoints group %q, ignoring it...\n", hash, group)
+			delete(groupdefs, hash)
+
+		}
+
+	}
+
+}
+
+// applyGroupdefs replaces the groupdefs
+func applyGroupdefs(data []byte) error {
+
+	// temporary variable for unpacking the data
+	var tmp map[string]string
+
+	// unmarshal json data gotten from the url
+	if err := json.Unmarshal(data, &tmp); err != nil {
+
+		return err
+
+	}
+
+	return updateState(func(next *discoveryState) error {
+
+		// move this data into the state
+		checkGroupdefs(tmp, next.endpoints)
+		next.groupdefsIndex = newTokenIndex("groupdefs", groupdefKeys(tmp))
+		next.groupdefs = tmp
+		return nil
+
+	})
+
+}
+
+// applyGroupdefsDelta adds, changes and removes some of the groupdefs
+func applyGroupdefsDelta(set json.RawMessage, remove []string) error {
+
+	// temporary variable for unpacking the data
+	tmp := map[string]string{}
+
+	// unmarshal the groupdefs that are added or changed
+	if len(set) != 0 {
+
+		if err := json.Unmarshal(set, &tmp); err != nil {
+
+			return err
+
+		}
+
+	}
+
+	return updateState(func(next *discoveryState) error {
+
+		// copy the current groupdefs, leaving out the removed ones
+		checkGroupdefs(tmp, next.endpoints)
+		groupdefs := make(map[string]string, len(next.groupdefs)+len(tmp))
+		for key, group := range next.groupdefs {
+
+			groupdefs[key] = group
+
+		}
+		for _, key := range remove {
+
+			delete(groupdefs, key)
+
+		}
+
+		// then add the new ones
+		for key, group := range tmp {
+
+			groupdefs[key] = group
+
+		}
+
+		// move this data into the state
+		next.groupdefsIndex = newTokenIndex("groupdefs", groupdefKeys(groupdefs))
+		next.groupdefs = groupdefs
+		return nil
+
+	})
+
+}
+
+// applyRollouts replaces the rollouts
+func applyRollouts(data []byte) error {
+
+	// temporary variable for unpacking the data
+	var tmp []rollout
+
+	// unmarshal json data gotten from the url
+	if err := json.Unmarshal(data, &tmp); err != nil {
+
+		return err
+
+	}
+
+	return updateState(func(next *discoveryState) error {
+
+		// make sure they all make sense
+		for i, candidate := range tmp {
+
+			if err := candidate.validate(next.endpoints); err != nil {
+
+				return fmt.Errorf("rollout %d: %v", i, err)
+
+			}
+
+		}
+
+		// move this data into the state
+		next.rollouts = tmp
+		return nil
+
+	})
+
+}
@@ -9,58 +9,64 @@ package main
 
 import (
 	// internals
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/hex"
-	"io/ioutil"
-	"net/http"
 	// externals
 	"golang.org/x/crypto/bcrypt"
 )
 
-// function to get data from a URL.
-// based on https://www.github.com/thbar/golang-playground/blob/master/download-files.go
-func get(url string) (string, error) {
-
-	// attempt to download the contents
-	res, err := http.Get(url)
+// object hashing
+func hash(object string, cost int) (string, error) {
 
-	// error handling
-	if err != nil {
+	// use bcrypt
+	bytes, err := bcrypt.GenerateFromPassword([]byte(object), cost)
 
-		// return an empty string, and the error
-		return "", err
+	// return that data as hexadecimal
+	return hex.EncodeToString(bytes), err
 
-	}
+}
 
-	// close request body stream once finished
-	defer res.Body.Close()
+// keyed, deterministic object hashing. unlike hash, the same object and
+// secret always give the same fingerprint, so it can be looked up in a map
+func fingerprint(object, secret string) string {
 
-	// read all data from body
-	data, err := ioutil.ReadAll(res.Body)
+	// use hmac-sha256 keyed with the secret
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(object))
 
-	// error handling
-	if err != nil {
+	// return that data as hexadecimal
+	return hex.EncodeToString(mac.Sum(nil))
 
-		// return an empty string, and the error
-		return "", err
+}
 
-	}
+// check if a string looks like a fingerprint
+func isFingerprint(object string) bool {
 
-	// convert the bytes to a string
-	ret := string(data[:])
+	// decode it from hexadecimal
+	bytes, err := hex.DecodeString(object)
 
-	// return the request response
-	return ret, nil
+	// fingerprints are hex-encoded sha256 sums
+	return err == nil && len(bytes) == sha256.Size
 
 }
 
-// object hashing
-func hash(object string, cost int) (string, error) {
+// check if a string looks like a hexadecimal-encoded bcrypt hash
+func isHash(object string) bool {
 
-	// use bcrypt
-	bytes, err := bcrypt.GenerateFromPassword([]byte(object), cost)
+	// decode it from hexadecimal
+	bytes, err := hex.DecodeString(object)
+	if err != nil {
 
-	// return that data as hexadecimal
-	return hex.EncodeToString(bytes), err
+		return false
+
+	}
+
+	// this parses the hash without doing any hashing
+	_, err = bcrypt.Cost(bytes)
+
+	// return if it's valid
+	return err == nil
 
 }
 
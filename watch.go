@@ -0,0 +1,217 @@
+/*
+
+discovery/watch.go
+
+keeping the data that is read from local files up to date
+by watching them for changes
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"encoding/json"
+	"errors"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	// externals
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// how long to wait for a file to stop changing before reading it
+const watchDelay = 250 * time.Millisecond
+
+// readSourceFile reads a source from a file, turning it into json if it's written in yaml
+func readSourceFile(file string) ([]byte, error) {
+
+	// json files are checked before they're used, so a half-written one is never applied
+	switch strings.ToLower(filepath.Ext(file)) {
+
+	case ".yaml", ".yml":
+		// read it
+		data, err := readFileByte(file)
+		if err != nil {
+
+			return nil, err
+
+		}
+
+		// convert it
+		var tmp interface{}
+		if err = yaml.Unmarshal(data, &tmp); err != nil {
+
+			return nil, err
+
+		}
+		return json.Marshal(tmp)
+
+	default:
+		// check it
+		valid, err := checkJSONValidity(file)
+		if err != nil {
+
+			return nil, err
+
+		}
+		if !valid {
+
+			return nil, errors.New("the file isn't valid json")
+
+		}
+
+		return readFileByte(file)
+
+	}
+
+}
+
+// loadSourceFile reads a source from a file and applies it, keeping the old data if it's invalid
+func loadSourceFile(name, file string, apply func(data []byte) error) bool {
+
+	// read it
+	data, err := readSourceFile(file)
+	if err == nil {
+
+		err = apply(data)
+
+	}
+
+	// check for errors
+	if err != nil {
+
+		log.Printf("[err]: unable to load %s from %s, keeping the data we have...\n", name, file)
+		log.Printf("       error: %v\n", err)
+		return false
+
+	}
+
+	return true
+
+}
+
+// watchSource reads a source from a file, and reads it again every time it changes
+func watchSource(name, file string, apply func(data []byte) error) {
+
+	// keep track of when this source first has data
+	var once sync.Once
+	sourcesReady.Add(1)
+
+	// read it for the first time
+	if loadSourceFile(name, file, apply) == true {
+
+		log.Printf("-> loaded %s from %s...\n", name, file)
+		once.Do(sourcesReady.Done)
+
+	}
+
+	// then read it again whenever it changes
+	watchFile(file, func() {
+
+		if loadSourceFile(name, file, apply) == true {
+
+			log.Printf("-> updated %s from %s...\n", name, file)
+			once.Do(sourcesReady.Done)
+
+		}
+
+	})
+
+}
+
+// watchFile calls changed every time a file changes, once it has stopped changing. the
+// directory is watched instead of the file itself, so files that are replaced instead of
+// written to (like by git, or editors that save to a temporary file first) are still seen
+func watchFile(file string, changed func()) {
+
+	// watch it
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+
+		log.Printf("[err]: unable to watch %s for changes...\n", file)
+		log.Printf("       error: %v\n", err)
+		return
+
+	}
+	if err = watcher.Add(filepath.Dir(file)); err != nil {
+
+		log.Printf("[err]: unable to watch %s for changes...\n", file)
+		log.Printf("       error: %v\n", err)
+		watcher.Close()
+		return
+
+	}
+
+	// start it
+	go func() {
+
+		// the timer that waits for the file to stop changing
+		var timer *time.Timer
+
+		// the changes are handled one at a time
+		reload := make(chan struct{}, 1)
+
+		// do this forever
+		for {
+
+			select {
+
+			case event, ok := <-watcher.Events:
+				if !ok {
+
+					return
+
+				}
+
+				// only the file we're watching matters
+				if filepath.Clean(event.Name) != filepath.Clean(file) || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+
+					continue
+
+				}
+
+				// wait for it to stop changing
+				if timer != nil {
+
+					timer.Stop()
+
+				}
+				timer = time.AfterFunc(watchDelay, func() {
+
+					select {
+
+					case reload <- struct{}{}:
+
+					default:
+
+					}
+
+				})
+
+			case <-reload:
+				changed()
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+
+					return
+
+				}
+
+				log.Printf("[err]: error while watching %s...\n", file)
+				log.Printf("       error: %v\n", err)
+
+			}
+
+		}
+
+	}()
+
+}
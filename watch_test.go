@@ -0,0 +1,149 @@
+/*
+
+discovery/watch_test.go
+
+tests for reading the data that is kept in local files
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadSourceFileKeepsTheOldData(t *testing.T) {
+
+	// the log isn't needed
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+
+	// start without any bans
+	storeState(newState(testConfig(t, "{}")))
+	defer storeState(&discoveryState{})
+	directory := t.TempDir()
+	key := fingerprint("servicetoken", "a-secret-that-is-long-enough")
+
+	for _, test := range []struct {
+		name, file, data string
+		loads            bool
+
+		// the reason of the ban that has to be in place afterwards
+		reason string
+	}{
+		{"a json file", "bans.json", fmt.Sprintf(`{%q: {"reason": "json"}}`, key), true, "json"},
+		{"a half-written json file", "bans.json", fmt.Sprintf(`{%q: {"reason": "half`, key), false, "json"},
+		{"a json file that isn't bans", "bans.json", `["not", "bans"]`, false, "json"},
+		{"a missing file", "missing.json", "", false, "json"},
+		{"a yaml file", "bans.yaml", fmt.Sprintf("%s:\n  reason: yaml\n", key), true, "yaml"},
+		{"an invalid yaml file", "bans.yaml", fmt.Sprintf("%s:\n  reason: [broken\n", key), false, "yaml"},
+		{"a yaml file that isn't bans", "bans.yml", "- not\n- bans\n", false, "yaml"},
+		{"a yaml file with the other extension", "bans.yml", fmt.Sprintf("%s: {reason: yml}\n", key), true, "yml"},
+	} {
+
+		// write the file
+		file := filepath.Join(directory, test.file)
+		if test.data != "" {
+
+			if err := os.WriteFile(file, []byte(test.data), 0644); err != nil {
+
+				t.Fatal(err)
+
+			}
+
+		}
+
+		// load it
+		if loaded := loadSourceFile("bans", file, applyBans); loaded != test.loads {
+
+			t.Errorf("%s: expected it to load: %t, got %t", test.name, test.loads, loaded)
+
+		}
+
+		// the old data has to be kept if it didn't
+		if entry, ok := loadState().bans[key]; !ok || entry.Reason != test.reason {
+
+			t.Errorf("%s: expected the ban with reason %q, got %+v", test.name, test.reason, loadState().bans)
+
+		}
+
+	}
+
+}
+
+func TestReadSourceFileConvertsYAMLTimestamps(t *testing.T) {
+
+	// the log isn't needed
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	storeState(newState(testConfig(t, "{}")))
+	defer storeState(&discoveryState{})
+
+	// bans written the way people write them by hand
+	key := fingerprint("servicetoken", "a-secret-that-is-long-enough")
+	file := filepath.Join(t.TempDir(), "bans.yaml")
+	data := fmt.Sprintf(`
+%s:
+  reason: "banned until {expires}"
+  expires: 2030-01-02T03:04:05Z
+  issued: 2024-06-01
+  issuer: someone
+`, key)
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+
+		t.Fatal(err)
+
+	}
+
+	// they have to come out as the same times
+	if loadSourceFile("bans", file, applyBans) == false {
+
+		t.Fatal("expected the bans to be loaded")
+
+	}
+	entry := loadState().bans[key]
+	if entry.Expires == nil || !entry.Expires.Equal(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)) {
+
+		t.Errorf("expected the ban to expire at 2030-01-02T03:04:05Z, got %v", entry.Expires)
+
+	}
+	if entry.Issued == nil || !entry.Issued.Equal(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)) {
+
+		t.Errorf("expected the ban to have been issued on 2024-06-01, got %v", entry.Issued)
+
+	}
+	if entry.Reason != "banned until {expires}" || entry.Issuer != "someone" {
+
+		t.Errorf("expected the rest of the ban to be kept, got %+v", entry)
+
+	}
+
+	// a timestamp with an offset is the same moment
+	data = fmt.Sprintf("%s: {reason: offset, expires: 2030-01-02T05:04:05+02:00}\n", key)
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+
+		t.Fatal(err)
+
+	}
+	if loadSourceFile("bans", file, applyBans) == false {
+
+		t.Fatal("expected the bans to be loaded")
+
+	}
+	if entry := loadState().bans[key]; entry.Expires == nil || !entry.Expires.Equal(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)) {
+
+		t.Errorf("expected the ban to expire at 2030-01-02T03:04:05Z, got %v", entry.Expires)
+
+	}
+
+}
@@ -0,0 +1,260 @@
+/*
+
+discovery/webhook.go
+
+the webhook, which lets a moderation backend push updates to
+discovery the moment they're made instead of waiting to be polled
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	// externals
+	"github.com/gorilla/mux"
+)
+
+// the most a single update can weigh
+const webhookMaxBody = 16 << 20
+
+// the secret that updates are signed with
+var webhookSecret string
+
+// how far off (in seconds) the time an update was signed at can be from ours
+var webhookMaxSkew int
+
+// webhookOptions is the webhook section of the options
+type webhookOptions struct {
+	Endpoint string
+	Secret   string
+	MaxSkew  int
+}
+
+// webhookUpdate is what is pushed to the webhook. snapshots replace everything with
+// data, while deltas add or change the entries in set and remove the ones in remove
+type webhookUpdate struct {
+	Type   string          `json:"type"`
+	Data   json.RawMessage `json:"data"`
+	Set    json.RawMessage `json:"set"`
+	Remove []string        `json:"remove"`
+}
+
+// webhookTarget is something that can be updated through the webhook
+type webhookTarget struct {
+	source   string
+	snapshot func(data []byte) error
+	delta    func(set json.RawMessage, remove []string) error
+}
+
+// the things that can be updated through the webhook, by the name used in its url
+var webhookTargets = map[string]webhookTarget{
+	"maintenance": {source: "maintenance status", snapshot: applyMaintenance},
+	"bans":        {source: "banlist", snapshot: applyBans, delta: applyBansDelta},
+	"ipBans":      {source: "ip bans", snapshot: applyIPBans, delta: applyIPBansDelta},
+	"groupdefs":   {source: "groupdefs", snapshot: applyGroupdefs, delta: applyGroupdefsDelta},
+	"rollouts":    {source: "rollouts", snapshot: applyRollouts},
+}
+
+// webhookReplays remembers the signatures of recent updates, so the same update can't
+// be sent again to undo the ones that came after it
+type webhookReplays struct {
+	lock sync.Mutex
+	seen map[string]time.Time
+}
+
+// the updates that were sent recently
+var recentWebhookUpdates = &webhookReplays{seen: map[string]time.Time{}}
+
+// replayed checks if an update with a signature was already sent, remembering it if it
+// wasn't. signatures are forgotten once their timestamp is too far away to be accepted
+func (w *webhookReplays) replayed(signature string, now time.Time) bool {
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	// forget the ones that can't be sent again anyway
+	for seen, expires := range w.seen {
+
+		if now.After(expires) {
+
+			delete(w.seen, seen)
+
+		}
+
+	}
+
+	// check this one
+	signature = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(signature), "sha256="))
+	if _, ok := w.seen[signature]; ok {
+
+		return true
+
+	}
+
+	// a timestamp can be up to maxSkew ahead of us, and is accepted until it's maxSkew behind
+	w.seen[signature] = now.Add(2 * time.Duration(webhookMaxSkew) * time.Second)
+	return false
+
+}
+
+// checkWebhookSignature checks that an update was signed with the secret. the signature
+// is the hexadecimal hmac-sha256 of the timestamp, a period and the body, so an old
+// update can't be sent again once it's too old
+func checkWebhookSignature(r *http.Request, body []byte, secret string, now time.Time) error {
+
+	// check the timestamp
+	timestamp := r.Header.Get("X-Discovery-Timestamp")
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+
+		return errors.New("missing or invalid X-Discovery-Timestamp")
+
+	}
+	if skew := now.Unix() - signedAt; skew > int64(webhookMaxSkew) || skew < -int64(webhookMaxSkew) {
+
+		return fmt.Errorf("the update was signed %d seconds away from now", skew)
+
+	}
+
+	// decode the signature
+	signature, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get("X-Discovery-Signature"), "sha256="))
+	if err != nil || len(signature) == 0 {
+
+		return errors.New("missing or invalid X-Discovery-Signature")
+
+	}
+
+	// work out what it should be
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	// compare them
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+
+		return errors.New("the signature doesn't match")
+
+	}
+
+	return nil
+
+}
+
+// the handler for the webhook
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+
+	// find out what is being updated
+	name := mux.Vars(r)["source"]
+	target, ok := webhookTargets[name]
+	if !ok {
+
+		http.Error(w, "unknown source", http.StatusNotFound)
+		return
+
+	}
+
+	// read the update
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, webhookMaxBody))
+	if err != nil {
+
+		http.Error(w, "unable to read the update", http.StatusBadRequest)
+		return
+
+	}
+
+	// make sure it came from someone who knows the secret
+	if err = checkWebhookSignature(r, body, webhookSecret, time.Now()); err != nil {
+
+		log.Printf("[err]: refused an update to %s from the webhook...\n", name)
+		log.Printf("       error: %v\n", err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+
+	}
+
+	// sources whose data has to be signed need updates to be signed the same way
+	if source := findSource(target.source); source != nil && len(source.source.PublicKeys) != 0 {
+
+		remote := source.source
+		if _, err = verifySignature(remote.PublicKeys, body, r.Header.Get(remote.SignatureHeader), r.Header.Get(signatureTimestampHeader(remote.SignatureHeader)), source.signedAt(), remote.SignatureMaxAge, time.Now()); err != nil {
+
+			log.Printf("[err]: refused an update to %s from the webhook...\n", name)
+			log.Printf("       error: %v\n", err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+
+		}
+
+	}
+
+	// the same update can only be applied once
+	if recentWebhookUpdates.replayed(r.Header.Get("X-Discovery-Signature"), time.Now()) {
+
+		log.Printf("[err]: refused an update to %s from the webhook that was already sent...\n", name)
+		http.Error(w, "the update was already sent", http.StatusConflict)
+		return
+
+	}
+
+	// unmarshal it
+	var update webhookUpdate
+	if err = json.Unmarshal(body, &update); err != nil {
+
+		http.Error(w, fmt.Sprintf("invalid update: %v", err), http.StatusBadRequest)
+		return
+
+	}
+
+	// apply it
+	switch {
+
+	case update.Type == "snapshot" && len(update.Data) != 0:
+		err = target.snapshot(update.Data)
+
+	case update.Type == "snapshot":
+		err = errors.New("a snapshot needs data")
+
+	case update.Type == "delta" && target.delta != nil:
+		err = target.delta(update.Set, update.Remove)
+
+	case update.Type == "delta":
+		err = fmt.Errorf("%s can only be updated with snapshots", name)
+
+	default:
+		err = fmt.Errorf("unknown update type %q (expected snapshot or delta)", update.Type)
+
+	}
+	if err != nil {
+
+		log.Printf("[err]: the update to %s from the webhook is invalid...\n", name)
+		log.Printf("       error: %v\n", err)
+		http.Error(w, fmt.Sprintf("invalid update: %v", err), http.StatusBadRequest)
+		return
+
+	}
+
+	// the next pull from the url checks the data against it, even if the url hasn't changed
+	reconcileSource(target.source)
+
+	// let the user know
+	log.Printf("-> updated %s from the webhook (%s)...\n", target.source, update.Type)
+	w.WriteHeader(http.StatusNoContent)
+
+}
@@ -0,0 +1,247 @@
+/*
+
+discovery/webhook_test.go
+
+tests for checking and applying updates pushed to the webhook
+
+written by superwhiskers, licensed under gnu agpl.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	// externals
+	"github.com/gorilla/mux"
+)
+
+// signWebhookUpdate signs an update the way the moderation backend does
+func signWebhookUpdate(r *http.Request, body, secret string, signedAt time.Time) {
+
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	r.Header.Set("X-Discovery-Timestamp", timestamp)
+	r.Header.Set("X-Discovery-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+}
+
+func TestCheckWebhookSignature(t *testing.T) {
+
+	// the settings the updates are checked with
+	defer func(skew int) { webhookMaxSkew = skew }(webhookMaxSkew)
+	webhookMaxSkew = 300
+	now := time.Unix(1700000000, 0)
+	body := `{"type":"snapshot","data":{}}`
+
+	for _, test := range []struct {
+		name  string
+		sign  func(r *http.Request)
+		fails bool
+	}{
+		{"signed", func(r *http.Request) { signWebhookUpdate(r, body, "secret", now) }, false},
+		{"signed a little while ago", func(r *http.Request) { signWebhookUpdate(r, body, "secret", now.Add(-299*time.Second)) }, false},
+		{"signed too long ago", func(r *http.Request) { signWebhookUpdate(r, body, "secret", now.Add(-301*time.Second)) }, true},
+		{"signed in the future", func(r *http.Request) { signWebhookUpdate(r, body, "secret", now.Add(301*time.Second)) }, true},
+		{"signed with another secret", func(r *http.Request) { signWebhookUpdate(r, body, "not-the-secret", now) }, true},
+		{"signed for another body", func(r *http.Request) { signWebhookUpdate(r, body+" ", "secret", now) }, true},
+		{"without the prefix", func(r *http.Request) {
+
+			signWebhookUpdate(r, body, "secret", now)
+			r.Header.Set("X-Discovery-Signature", strings.TrimPrefix(r.Header.Get("X-Discovery-Signature"), "sha256="))
+
+		}, false},
+		{"with another timestamp", func(r *http.Request) {
+
+			signWebhookUpdate(r, body, "secret", now)
+			r.Header.Set("X-Discovery-Timestamp", strconv.FormatInt(now.Unix()+1, 10))
+
+		}, true},
+		{"without a timestamp", func(r *http.Request) {
+
+			signWebhookUpdate(r, body, "secret", now)
+			r.Header.Del("X-Discovery-Timestamp")
+
+		}, true},
+		{"without a signature", func(r *http.Request) {}, true},
+		{"with a signature that isn't hexadecimal", func(r *http.Request) {
+
+			signWebhookUpdate(r, body, "secret", now)
+			r.Header.Set("X-Discovery-Signature", "sha256=nope")
+
+		}, true},
+	} {
+
+		r := httptest.NewRequest("POST", "/webhook/bans", strings.NewReader(body))
+		test.sign(r)
+		err := checkWebhookSignature(r, []byte(body), "secret", now)
+		if test.fails == true && err == nil {
+
+			t.Errorf("%s: expected an error", test.name)
+
+		} else if test.fails == false && err != nil {
+
+			t.Errorf("%s: %v", test.name, err)
+
+		}
+
+	}
+
+}
+
+func TestWebhookHandler(t *testing.T) {
+
+	// a state without any ip bans
+	defer func(secret string, skew int) { webhookSecret, webhookMaxSkew = secret, skew }(webhookSecret, webhookMaxSkew)
+	webhookSecret, webhookMaxSkew = "secret", 300
+	defer storeState(&discoveryState{})
+	storeState(&discoveryState{})
+
+	// the webhook
+	router := mux.NewRouter()
+	router.HandleFunc("/webhook/{source}", webhookHandler).Methods("POST")
+	send := func(source, body string, sign bool) int {
+
+		r := httptest.NewRequest("POST", "/webhook/"+source, strings.NewReader(body))
+		if sign == true {
+
+			signWebhookUpdate(r, body, "secret", time.Now())
+
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+
+	}
+	delta := `{"type":"delta","set":{"203.0.113.0/24":{"reason":"haha-yes"}}}`
+
+	for _, test := range []struct {
+		name, source, body string
+		sign               bool
+		expected           int
+	}{
+		{"an unsigned update", "ipBans", delta, false, http.StatusUnauthorized},
+		{"an unknown source", "nothing", delta, true, http.StatusNotFound},
+		{"an unknown update type", "ipBans", `{"type":"everything"}`, true, http.StatusBadRequest},
+		{"a snapshot without data", "ipBans", `{"type":"snapshot"}`, true, http.StatusBadRequest},
+		{"a delta to a source that only takes snapshots", "rollouts", `{"type":"delta","set":{}}`, true, http.StatusBadRequest},
+		{"a delta", "ipBans", delta, true, http.StatusNoContent},
+	} {
+
+		if code := send(test.source, test.body, test.sign); code != test.expected {
+
+			t.Errorf("%s: expected %d, got %d", test.name, test.expected, code)
+
+		}
+
+	}
+
+	// only the signed delta changed anything
+	if bans := loadState().ipBans; len(bans) != 1 || bans[0].Reason != "haha-yes" {
+
+		t.Fatalf("expected the ip ban from the delta, got %+v", bans)
+
+	}
+
+	// an update can't be sent again
+	removal := `{"type":"delta","remove":["203.0.113.0/24"]}`
+	r := httptest.NewRequest("POST", "/webhook/ipBans", strings.NewReader(removal))
+	signWebhookUpdate(r, removal, "secret", time.Now())
+	for i, expected := range []int{http.StatusNoContent, http.StatusConflict} {
+
+		replayed := httptest.NewRequest("POST", "/webhook/ipBans", strings.NewReader(removal))
+		replayed.Header = r.Header.Clone()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, replayed)
+		if w.Code != expected {
+
+			t.Errorf("sending it %d times: expected %d, got %d", i+1, expected, w.Code)
+
+		}
+
+	}
+
+}
+
+func TestWebhookHandlerChecksSignedSources(t *testing.T) {
+
+	// a state without any bans, pulled from a url whose data has to be signed
+	defer func(secret string, skew int) { webhookSecret, webhookMaxSkew = secret, skew }(webhookSecret, webhookMaxSkew)
+	webhookSecret, webhookMaxSkew = "secret", 300
+	defer storeState(&discoveryState{})
+	storeState(&discoveryState{})
+	public, private := testKeys(t)
+	source := newFetcher("banlist", remoteSource{URL: "https://moderation.your-host.xyz/bans", PublicKeys: []ed25519.PublicKey{public}, SignatureHeader: defaultSignatureHeader}, fetchOptions{})
+	source.current = time.Now().Add(-time.Minute)
+	defer func(previous []*fetcher) { sources = previous }(sources)
+	sources = []*fetcher{source}
+
+	// the webhook
+	router := mux.NewRouter()
+	router.HandleFunc("/webhook/{source}", webhookHandler).Methods("POST")
+	snapshot := func(reason string) string {
+
+		return fmt.Sprintf(`{"type":"snapshot","data":{%q:{"reason":%q}}}`, fingerprint("servicetoken", "a-secret-that-is-long-enough"), reason)
+
+	}
+
+	for _, test := range []struct {
+		name     string
+		body     string
+		signedAt time.Time
+		expected int
+	}{
+		{"an update that is only signed with the secret", snapshot("unsigned"), time.Time{}, http.StatusUnauthorized},
+		{"an update signed before the data we have", snapshot("old"), time.Now().Add(-2 * time.Minute), http.StatusUnauthorized},
+		{"a signed update", snapshot("signed"), time.Now(), http.StatusNoContent},
+	} {
+
+		r := httptest.NewRequest("POST", "/webhook/bans", strings.NewReader(test.body))
+		signWebhookUpdate(r, test.body, "secret", time.Now())
+		if !test.signedAt.IsZero() {
+
+			signature, timestamp := signTestData(private, test.body, test.signedAt)
+			r.Header.Set("X-Signature", signature)
+			r.Header.Set("X-Signature-Timestamp", timestamp)
+
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != test.expected {
+
+			t.Errorf("%s: expected %d, got %d", test.name, test.expected, w.Code)
+
+		}
+
+	}
+
+	// only the signed one was applied
+	for _, banned := range loadState().bans {
+
+		if banned.Reason != "signed" {
+
+			t.Fatalf("expected only the signed update to be applied, got %+v", loadState().bans)
+
+		}
+
+	}
+	if len(loadState().bans) != 1 {
+
+		t.Fatalf("expected the signed update to be applied, got %+v", loadState().bans)
+
+	}
+
+}